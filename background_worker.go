@@ -1,47 +1,114 @@
 package jobinator
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"github.com/gofrs/uuid"
 )
 
 //BackgroundWorker represents a worker thread that runs in the background
 type BackgroundWorker struct {
 	c        *Client
 	quitChan chan bool
+	doneChan chan bool //closed once the background worker has stopped running
+	wakeChan chan bool
+	cancel   context.CancelFunc
 	running  bool
 	runMutex sync.Mutex
+	queues   []string
+	id       string
 }
 
-//NewBackgroundWorker returns a background worker handle, as well as registers it in the client. You can either keep it to start it yourself or use the client to start all background worker threads.
-func (c *Client) NewBackgroundWorker() *BackgroundWorker {
+//NewBackgroundWorker returns a background worker handle, as well as registers it in the client. You can either keep it to start it yourself or use the client to start all background worker threads. If queues are given, the worker only runs jobs from those queues, otherwise it runs jobs from every queue.
+func (c *Client) NewBackgroundWorker(queues ...string) *BackgroundWorker {
 	bw := &BackgroundWorker{
 		running:  false,
 		c:        c,
 		runMutex: sync.Mutex{},
+		queues:   queues,
+		wakeChan: make(chan bool, 1),
+		id:       uuid.Must(uuid.NewV4()).String(),
 	}
+	c.workerLock.Lock()
 	c.workers = append(c.workers, bw)
+	c.workerLock.Unlock()
 	return bw
 }
 
-func (bw *BackgroundWorker) backgroundWorkerFunc() {
-	bw.runMutex.Lock()
-	bw.running = true
-	bw.runMutex.Unlock()
+//backgroundWorkerFunc keeps running jobs as long as there are any available. Once it runs out, it waits for WorkerSleepTime or until it is woken up before it looks again.
+func (bw *BackgroundWorker) backgroundWorkerFunc(quit chan bool, done chan bool) {
+	idle := false
 	for {
 		select {
-		case <-bw.quitChan:
+		case <-quit:
 			bw.runMutex.Lock()
 			bw.running = false
 			bw.runMutex.Unlock()
+			close(done)
 			return
 		default:
-			time.Sleep(bw.c.config.WorkerSleepTime)
-			bw.c.backgroundExecute()
+			if idle {
+				bw.c.reapExpiredJobsIfDue()
+				bw.wait(quit)
+			}
+			idle = !bw.execute(quit)
 		}
 	}
 }
 
+//wait returns after WorkerSleepTime, or earlier if the background worker is woken up or stopped.
+func (bw *BackgroundWorker) wait(quit chan bool) {
+	timer := time.NewTimer(bw.c.config.WorkerSleepTime)
+	defer timer.Stop()
+	select {
+	case <-bw.wakeChan:
+	case <-timer.C:
+	case <-quit:
+	}
+}
+
+//wake interrupts the wait of an idle background worker. It never blocks.
+func (bw *BackgroundWorker) wake() {
+	select {
+	case bw.wakeChan <- true:
+	default:
+	}
+}
+
+//execute runs a single job with a context that Stop() can cancel. It returns false if there was no job to run, or if the background worker has been stopped.
+func (bw *BackgroundWorker) execute(quit chan bool) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	bw.runMutex.Lock()
+	select {
+	case <-quit:
+		//Stop has been called, and it only cancels contexts it can see under runMutex
+		bw.runMutex.Unlock()
+		cancel()
+		return false
+	default:
+	}
+	bw.cancel = cancel
+	bw.runMutex.Unlock()
+	ran := bw.c.backgroundExecute(ctx, SelectConfig{
+		Queues:        bw.queues,
+		WorkerID:      bw.id,
+		LeaseDuration: bw.c.leaseDuration(),
+		Abandoned:     bw.c.abandonedJobs(),
+	})
+	bw.runMutex.Lock()
+	bw.cancel = nil
+	bw.runMutex.Unlock()
+	cancel()
+	return ran
+}
+
+//ID returns the unique ID of the background worker. Jobs it runs are locked by this ID.
+func (bw *BackgroundWorker) ID() string {
+	return bw.id
+}
+
 //IsRunning returns whether or not the background worker is running.
 func (bw *BackgroundWorker) IsRunning() bool {
 	bw.runMutex.Lock()
@@ -51,24 +118,38 @@ func (bw *BackgroundWorker) IsRunning() bool {
 
 //Start starts the background worker. If it is already running, nothing happens.
 func (bw *BackgroundWorker) Start() {
-	if bw.IsRunning() {
+	bw.runMutex.Lock()
+	defer bw.runMutex.Unlock()
+	if bw.running {
 		return
 	}
 	bw.quitChan = make(chan bool)
-	go bw.backgroundWorkerFunc()
+	bw.doneChan = make(chan bool)
+	bw.running = true
+	go bw.backgroundWorkerFunc(bw.quitChan, bw.doneChan)
 }
 
-//Stop stops the background worker. This is non blocking, so it may take some time before the background worker is fully stopped. Use IsRunning() to see if it's still running.
+//Stop stops the background worker and cancels the context of the job it is currently running, if any. If the job returns an error because of it, the job is put back into the queue without counting as a failed try. It may take some time before the background worker is fully stopped. Use IsRunning() to see if it's still running.
 func (bw *BackgroundWorker) Stop() {
-	if bw.IsRunning() {
-		bw.quitChan <- true
+	bw.runMutex.Lock()
+	defer bw.runMutex.Unlock()
+	if !bw.running || bw.quitChan == nil {
+		return
 	}
+	if bw.cancel != nil {
+		bw.cancel()
+	}
+	close(bw.quitChan)
+	bw.quitChan = nil
 }
 
 //StopBlocking stops the background worker. It will block until the background worker has stopped running.
 func (bw *BackgroundWorker) StopBlocking() {
+	bw.runMutex.Lock()
+	done := bw.doneChan
+	bw.runMutex.Unlock()
 	bw.Stop()
-	for bw.IsRunning() == true {
-		time.Sleep(bw.c.config.WorkerSleepTime / 2)
+	if done != nil {
+		<-done
 	}
 }
@@ -0,0 +1,64 @@
+package jobinator
+
+import (
+	"math/rand"
+	"time"
+)
+
+//duration returns the delay before the retry that follows retryCount failed tries.
+func (b Backoff) duration(retryCount int, err error) time.Duration {
+	if b.Func != nil {
+		return b.Func(retryCount, err)
+	}
+	var d time.Duration
+	switch b.Strategy {
+	case BackoffConstant:
+		d = b.Delay
+	case BackoffLinear:
+		d = b.Delay * time.Duration(retryCount)
+	case BackoffExponential:
+		d = b.Delay
+		for i := 1; i < retryCount; i++ {
+			if b.MaxDelay > 0 && d >= b.MaxDelay {
+				break
+			}
+			if d > time.Duration(1<<62) {
+				break
+			}
+			d *= 2
+		}
+	default:
+		return 0
+	}
+	if b.MaxDelay > 0 && d > b.MaxDelay {
+		d = b.MaxDelay
+	}
+	if b.Jitter && d > 1 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)))
+	}
+	return d
+}
+
+//jobBackoff rebuilds the backoff policy of a job, including a custom BackoffFunc if it was enqueued by this client.
+func (c *Client) jobBackoff(j *Job) Backoff {
+	b := Backoff{
+		Strategy: j.BackoffStrategy,
+		Delay:    j.BackoffDelay,
+		MaxDelay: j.BackoffMaxDelay,
+		Jitter:   j.BackoffJitter,
+	}
+	c.backoffLock.Lock()
+	b.Func = c.backoffFuncs[j.ID]
+	c.backoffLock.Unlock()
+	return b
+}
+
+func (c *Client) setBackoffFunc(id string, f BackoffFunc) {
+	c.backoffLock.Lock()
+	defer c.backoffLock.Unlock()
+	if f == nil {
+		delete(c.backoffFuncs, id)
+		return
+	}
+	c.backoffFuncs[id] = f
+}
@@ -0,0 +1,116 @@
+package jobinator
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blasphemy/jobinator/status"
+	"github.com/gofrs/uuid"
+)
+
+//ErrNamedJobInBatch is returned by EnqueueBatch when one of the jobs has an Identifier. Named jobs may already exist, so they can't be added to a new batch.
+var ErrNamedJobInBatch = errors.New("named jobs can't be part of a batch")
+
+//ErrBatchNotFound is returned when a batch doesn't exist.
+var ErrBatchNotFound = errors.New("Batch not found")
+
+//batchHookPrefix is prepended to the name of a batch hook to get the name of the worker that runs it
+const batchHookPrefix = "jobinator.batch_hook."
+
+//BatchHook is called once every job in a batch has finished
+type BatchHook func(b *Batch) error
+
+//BatchConfig includes options for when a batch is queued
+type BatchConfig struct {
+	Callback *JobSpec //job queued up once every job in the batch has finished. Its JobRef.BatchID returns the batch. DependsOn is ignored for it
+	Hook     string   //name of a hook registered with RegisterBatchHook to call once every job in the batch has finished. Ignored if Callback is set
+}
+
+//Finished returns whether every job in the batch has finished.
+func (b *Batch) Finished() bool {
+	return b.FinishedAt > 0
+}
+
+//RegisterBatchHook registers a hook that batches can name in their BatchConfig. The hook is run by a worker like any other job, so it has to be registered on a client that runs background workers. A hook that returns an error is retried according to its job's MaxRetry.
+func (c *Client) RegisterBatchHook(name string, hook BatchHook) {
+	c.RegisterWorker(batchHookPrefix+name, func(j *JobRef) error {
+		b, err := c.GetBatch(j.BatchID())
+		if err != nil {
+			return err
+		}
+		return hook(b)
+	})
+}
+
+//EnqueueBatch queues up jobs as a batch. The backend counts how many of them succeed or fail, and once all of them have finished, the callback job or hook from the BatchConfig is queued up. A job that is retried with RetryJob or RetryAllFailed before the batch has finished is only counted once it finishes again. Either all jobs are queued up or, if there is an error, none are. Repeating jobs never finish, so a batch with repeating jobs never finishes either.
+func (c *Client) EnqueueBatch(specs []JobSpec, config BatchConfig) (*Batch, []EnqueueResult, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, nil, err
+	}
+	b := &Batch{
+		ID:        id.String(),
+		Total:     len(specs),
+		CreatedAt: time.Now().Unix(),
+	}
+	if b.Total == 0 {
+		b.FinishedAt = b.CreatedAt
+	}
+	jobs := make([]*Job, len(specs))
+	for i, x := range specs {
+		if x.Config.Identifier != "" {
+			return nil, nil, ErrNamedJobInBatch
+		}
+		j, err := NewJob(x.Name, x.Args, x.Config)
+		if err != nil {
+			return nil, nil, err
+		}
+		j.BatchID = b.ID
+		jobs[i] = j
+	}
+	callback := config.Callback
+	if callback == nil && config.Hook != "" {
+		callback = &JobSpec{
+			Name: batchHookPrefix + config.Hook,
+		}
+	}
+	var cj *Job
+	if callback != nil {
+		if callback.Config.Identifier != "" {
+			return nil, nil, ErrNamedJobInBatch
+		}
+		cj, err = NewJob(callback.Name, callback.Args, callback.Config)
+		if err != nil {
+			return nil, nil, err
+		}
+		cj.BatchID = b.ID
+		cj.DependsOn = nil
+		cj.Status = status.Pending
+		if !b.Finished() {
+			cj.Status = status.Waiting
+		}
+		b.CallbackJobID = cj.ID
+	}
+	err = c.InternalEnqueueBatch(b, jobs, cj)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]EnqueueResult, len(jobs))
+	for i, x := range jobs {
+		c.setBackoffFunc(x.ID, specs[i].Config.Backoff.Func)
+		results[i] = EnqueueResult{
+			ID:      x.ID,
+			Created: true,
+		}
+	}
+	if cj != nil {
+		c.setBackoffFunc(cj.ID, callback.Config.Backoff.Func)
+	}
+	c.wakeAllWorkers()
+	return b, results, nil
+}
+
+//GetBatch returns the batch with the given ID, or ErrBatchNotFound.
+func (c *Client) GetBatch(id string) (*Batch, error) {
+	return c.InternalGetBatch(id)
+}
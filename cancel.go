@@ -0,0 +1,37 @@
+package jobinator
+
+import (
+	"errors"
+)
+
+//ErrJobNotFound is returned when a job doesn't exist.
+var ErrJobNotFound = errors.New("Job not found")
+
+//ErrJobFinished is returned when trying to cancel a job that has already finished.
+var ErrJobFinished = errors.New("job has already finished")
+
+//CancelJob cancels a job that hasn't finished yet. A pending job won't be run anymore. If the job is running, its context is cancelled so the worker can stop early, and whatever the worker returns is ignored. A cancelled repeating job doesn't repeat anymore.
+func (c *Client) CancelJob(id string) error {
+	err := c.InternalCancelJob(id)
+	if err != nil {
+		return err
+	}
+	c.jobCancelled(id)
+	return nil
+}
+
+//CancelNamedJob is like CancelJob, for a job enqueued with an Identifier.
+func (c *Client) CancelNamedJob(identifier string) error {
+	id, err := c.InternalCancelNamedJob(identifier)
+	if err != nil {
+		return err
+	}
+	c.jobCancelled(id)
+	return nil
+}
+
+//jobCancelled stops the job if it's running on this client. Jobs running on other clients notice when they try to renew their lease.
+func (c *Client) jobCancelled(id string) {
+	c.cancelRunningJob(id, true)
+	c.setBackoffFunc(id, nil)
+}
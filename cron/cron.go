@@ -0,0 +1,231 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Schedule is a parsed cron expression
+type Schedule struct {
+	second  uint64
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+	loc     *time.Location
+}
+
+type bounds struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	seconds = bounds{0, 59, nil}
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	//7 is accepted as sunday and folded into 0 after parsing
+	dows = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+//Parse parses a cron expression. It accepts the standard 5 field syntax (minute hour day-of-month month day-of-week), a 6 field syntax with a leading seconds field, and the @yearly, @monthly, @weekly, @daily and @hourly descriptors. The expression can be prefixed with CRON_TZ=<zone> or TZ=<zone> to evaluate it in that time zone, otherwise the time zone of the time passed to Next is used.
+func Parse(spec string) (*Schedule, error) {
+	s := &Schedule{}
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.Index(spec, " ")
+		if i == -1 {
+			return nil, fmt.Errorf("cron: missing schedule after time zone in %q", spec)
+		}
+		zone := spec[strings.Index(spec, "=")+1 : i]
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("cron: invalid time zone %q: %v", zone, err)
+		}
+		s.loc = loc
+		spec = strings.TrimSpace(spec[i:])
+	}
+	if strings.HasPrefix(spec, "@") {
+		d, ok := descriptors[strings.ToLower(spec)]
+		if !ok {
+			return nil, fmt.Errorf("cron: unknown descriptor %q", spec)
+		}
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron: expected 5 or 6 fields, found %d in %q", len(fields), spec)
+	}
+	var err error
+	if s.second, err = parseField(fields[0], seconds); err != nil {
+		return nil, err
+	}
+	if s.minute, err = parseField(fields[1], minutes); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[2], hours); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[3], doms); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[4], months); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[5], dows); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domStar = fields[3] == "*" || fields[3] == "?"
+	s.dowStar = fields[5] == "*" || fields[5] == "?"
+	return s, nil
+}
+
+//parseField parses a comma separated list of values, ranges and steps into a bit set.
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		r, err := parseRange(part, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= r
+	}
+	return bits, nil
+}
+
+func parseRange(expr string, b bounds) (uint64, error) {
+	rangeExpr := expr
+	step := 1
+	if i := strings.Index(expr, "/"); i != -1 {
+		var err error
+		step, err = strconv.Atoi(expr[i+1:])
+		if err != nil || step <= 0 {
+			return 0, fmt.Errorf("cron: invalid step in %q", expr)
+		}
+		rangeExpr = expr[:i]
+	}
+	var start, end int
+	switch {
+	case rangeExpr == "*" || rangeExpr == "?":
+		start, end = b.min, b.max
+	case strings.Contains(rangeExpr, "-"):
+		i := strings.Index(rangeExpr, "-")
+		var err error
+		if start, err = parseValue(rangeExpr[:i], b); err != nil {
+			return 0, err
+		}
+		if end, err = parseValue(rangeExpr[i+1:], b); err != nil {
+			return 0, err
+		}
+	default:
+		var err error
+		if start, err = parseValue(rangeExpr, b); err != nil {
+			return 0, err
+		}
+		end = start
+		if strings.Contains(expr, "/") {
+			//N/S means every S starting at N
+			end = b.max
+		}
+	}
+	if start > end {
+		return 0, fmt.Errorf("cron: invalid range %q", expr)
+	}
+	var bits uint64
+	for i := start; i <= end; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+func parseValue(v string, b bounds) (int, error) {
+	if n, ok := b.names[strings.ToLower(v)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("cron: invalid value %q", v)
+	}
+	if n < b.min || n > b.max {
+		return 0, fmt.Errorf("cron: value %d out of range [%d, %d]", n, b.min, b.max)
+	}
+	return n, nil
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+//dayMatches follows the usual cron rule: if both day-of-month and day-of-week are restricted, either one matching is enough.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := has(s.dom, t.Day())
+	dowMatch := has(s.dow, int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+//Next returns the first time after t that matches the schedule, or the zero time if there is none within the next five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = t.Location()
+	}
+	t = t.In(loc).Truncate(time.Second).Add(time.Second)
+	yearLimit := t.Year() + 5
+	for t.Year() <= yearLimit {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if !has(s.second, t.Second()) {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
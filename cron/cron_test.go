@@ -0,0 +1,67 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrors(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"@never",
+		"TZ=Nowhere/Nothing * * * * *",
+	}
+	for _, spec := range specs {
+		_, err := Parse(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	start := time.Date(2018, time.August, 24, 13, 37, 12, 0, time.UTC) //a friday
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2018, time.August, 24, 13, 38, 0, 0, time.UTC)},
+		{"*/15 * * * * *", time.Date(2018, time.August, 24, 13, 37, 15, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2018, time.August, 25, 2, 0, 0, 0, time.UTC)},
+		{"0 2 * * MON-FRI", time.Date(2018, time.August, 27, 2, 0, 0, 0, time.UTC)},
+		{"30 9 1,15 * *", time.Date(2018, time.September, 1, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * 7", time.Date(2018, time.August, 26, 12, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2018, time.August, 24, 14, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2018, time.September, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, x := range tests {
+		s, err := Parse(x.spec)
+		assert.Nil(t, err, x.spec)
+		assert.True(t, x.next.Equal(s.Next(start)), "%s: expected %v, got %v", x.spec, x.next, s.Next(start))
+	}
+}
+
+func TestNextTimeZone(t *testing.T) {
+	s, err := Parse("CRON_TZ=America/New_York 0 2 * * *")
+	assert.Nil(t, err)
+	ny, err := time.LoadLocation("America/New_York")
+	assert.Nil(t, err)
+	start := time.Date(2018, time.August, 24, 13, 37, 0, 0, time.UTC)
+	assert.True(t, time.Date(2018, time.August, 25, 2, 0, 0, 0, ny).Equal(s.Next(start)))
+}
+
+func TestNextNever(t *testing.T) {
+	s, err := Parse("0 0 30 2 *")
+	assert.Nil(t, err)
+	assert.True(t, s.Next(time.Now()).IsZero())
+}
@@ -0,0 +1,8 @@
+package jobinator
+
+import (
+	"errors"
+)
+
+//ErrDependencyFailed is recorded as the job's error when a job it depends on fails, times out or is cancelled.
+var ErrDependencyFailed = errors.New("a job this job depends on didn't finish successfully")
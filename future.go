@@ -0,0 +1,93 @@
+package jobinator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/blasphemy/jobinator/status"
+)
+
+//DefaultPollInterval is how often futures check on their job when neither the storage backend can notify them nor ClientConfig.WorkerSleepTime is set.
+const DefaultPollInterval = time.Second
+
+//ErrJobCancelled is returned by Future.Wait when the job was cancelled.
+var ErrJobCancelled = errors.New("job was cancelled")
+
+//JobError is returned by Future.Wait when the job failed or timed out.
+type JobError struct {
+	Status  int
+	Message string //the error recorded by the job's last try
+}
+
+func (e *JobError) Error() string {
+	return e.Message
+}
+
+//Future is a handle on an enqueued job that can wait for the job to finish.
+type Future struct {
+	c  *Client
+	id string
+}
+
+//EnqueueFuture is like EnqueueJob, and returns a Future to wait for the job's result. For a named job that was already enqueued, the future waits for the existing job.
+func (c *Client) EnqueueFuture(name string, args interface{}, config JobConfig) (*Future, error) {
+	res, err := c.Enqueue(name, args, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Future{
+		c:  c,
+		id: res.ID,
+	}, nil
+}
+
+//ID returns the ID of the job the future is waiting for.
+func (f *Future) ID() string {
+	return f.id
+}
+
+//Wait blocks until the job is done, has failed, has timed out or was cancelled, or until the context is done. It returns the job's result if it is done, otherwise ErrJobCancelled, a *JobError or the context's error. Repeating jobs don't finish, so waiting for them only returns once the context is done.
+func (f *Future) Wait(ctx context.Context) ([]byte, error) {
+	var changed <-chan struct{}
+	if w, ok := f.c.InternalClient.(JobWatcher); ok {
+		ch, stop := w.InternalWatchJob(f.id)
+		defer stop()
+		changed = ch
+	}
+	interval := f.c.config.WorkerSleepTime
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		j, err := f.c.GetJob(f.id)
+		if err != nil {
+			return nil, err
+		}
+		if status.Finished(j.Status) {
+			return futureResult(j)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+			changed = nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func futureResult(j *Job) ([]byte, error) {
+	switch j.Status {
+	case status.Done:
+		return j.Result, nil
+	case status.Cancelled:
+		return nil, ErrJobCancelled
+	}
+	return nil, &JobError{
+		Status:  j.Status,
+		Message: j.Error,
+	}
+}
@@ -0,0 +1,100 @@
+package gormclient
+
+import (
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/status"
+	"github.com/jinzhu/gorm"
+)
+
+//InternalEnqueueBatch queues up the batch, its jobs and its callback job in one transaction. The callback job is inserted first, since jobs that fail because of a job they depend on finish right away and may finish the batch.
+func (c *GormClient) InternalEnqueueBatch(b *jobinator.Batch, jobs []*jobinator.Job, callback *jobinator.Job) error {
+	tx := c.db.Begin()
+	err := tx.Create(b).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if callback != nil {
+		err := insertJobs(tx, []*jobinator.Job{callback})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	insert := []*jobinator.Job{}
+	for _, x := range jobs {
+		if bulkInsertable(x) {
+			insert = append(insert, x)
+			continue
+		}
+		_, err := enqueueJob(tx, x)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = insertJobs(tx, insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+//InternalGetBatch returns the batch with the given ID.
+func (c *GormClient) InternalGetBatch(id string) (*jobinator.Batch, error) {
+	b := &jobinator.Batch{}
+	q := c.db.First(b, "id = ?", id)
+	if q.RecordNotFound() {
+		return nil, jobinator.ErrBatchNotFound
+	}
+	if q.Error != nil {
+		return nil, q.Error
+	}
+	return b, nil
+}
+
+//jobFinished is called after a job has finished, to count it in its batch and to resolve the jobs depending on it.
+func jobFinished(db *gorm.DB, id string) error {
+	j := &jobinator.Job{}
+	err := db.Select("id, status, batch_id").First(j, "id = ?", id).Error
+	if err != nil {
+		return err
+	}
+	if j.BatchID != "" {
+		err := batchJobFinished(db, j)
+		if err != nil {
+			return err
+		}
+	}
+	return resolveDependents(db, id)
+}
+
+//batchJobRetried takes back the count of a failed or timed out job of a batch that is retried, as long as the batch hasn't finished.
+func batchJobRetried(db *gorm.DB, j *jobinator.Job) error {
+	return db.Model(&jobinator.Batch{}).Where("id = ? AND callback_job_id <> ? AND finished_at = 0", j.BatchID, j.ID).Update("failed", gorm.Expr("failed - ?", 1)).Error
+}
+
+//batchJobFinished counts a finished job of a batch, and queues up the batch's callback job if it was the last one. Only one of the jobs can set finished_at, so the callback job is queued up once even if the last jobs finish at the same time.
+func batchJobFinished(db *gorm.DB, j *jobinator.Job) error {
+	column := "failed"
+	if j.Status == status.Done {
+		column = "succeeded"
+	}
+	res := db.Model(&jobinator.Batch{}).Where("id = ? AND callback_job_id <> ? AND finished_at = 0", j.BatchID, j.ID).Update(column, gorm.Expr(column+" + ?", 1))
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+	res = db.Model(&jobinator.Batch{}).Where("id = ? AND finished_at = 0 AND succeeded + failed >= total", j.BatchID).Update("finished_at", time.Now().Unix())
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+	b := &jobinator.Batch{}
+	err := db.Select("callback_job_id").First(b, "id = ?", j.BatchID).Error
+	if err != nil || b.CallbackJobID == "" {
+		return err
+	}
+	return db.Model(&jobinator.Job{}).Where("id = ? AND status = ?", b.CallbackJobID, status.Waiting).Update("status", status.Pending).Error
+}
@@ -0,0 +1,47 @@
+package gormclient
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/status"
+	"github.com/jinzhu/gorm"
+)
+
+//errWorkerFull is returned by InternalSelectJob when other processes started jobs of the worker after fullWorkers counted them.
+var errWorkerFull = errors.New("worker is already running as many jobs as its MaxConcurrency allows")
+
+//ConcurrencyLock is the row of a worker with a MaxConcurrency, shared by all processes using the database. Starting a job of the worker updates the row first, which locks it until the transaction ends, so the worker's running jobs are counted by one process at a time.
+type ConcurrencyLock struct {
+	Name     string `gorm:"primary_key"`
+	LockedAt int64  //unix nanoseconds
+}
+
+//checkConcurrency locks the worker's ConcurrencyLock and counts its running jobs again, since fullWorkers counted them without a lock. Abandoned jobs are only known to this process, so they are passed in. It returns errWorkerFull if another job of the worker can't be started.
+func checkConcurrency(db *gorm.DB, name string, limit int, abandoned int) error {
+	now := time.Now().UnixNano()
+	res := db.Model(&ConcurrencyLock{}).Where("name = ?", name).Update("locked_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		//if several processes create the row at the same time, only one of them succeeds and the others try again later
+		err := db.Create(&ConcurrencyLock{
+			Name:     name,
+			LockedAt: now,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	running := 0
+	err := db.Model(&jobinator.Job{}).Where("name = ? AND status = ?", name, status.Running).Count(&running).Error
+	if err != nil {
+		return err
+	}
+	if running+abandoned >= limit {
+		return errWorkerFull
+	}
+	return nil
+}
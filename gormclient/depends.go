@@ -0,0 +1,114 @@
+package gormclient
+
+import (
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
+	"github.com/blasphemy/jobinator/status"
+	"github.com/jinzhu/gorm"
+)
+
+//JobDependency stores that a job depends on another job, since a job's DependsOn list can't be stored in the jobs table.
+type JobDependency struct {
+	JobID     string `gorm:"primary_key"`
+	DependsOn string `gorm:"primary_key;index"`
+}
+
+//insertDependencies stores the dependencies of a new job and sets its status depending on the jobs it depends on.
+func insertDependencies(db *gorm.DB, j *jobinator.Job) error {
+	var statuses []int
+	err := db.Model(&jobinator.Job{}).Where("id in (?)", j.DependsOn).Pluck("status", &statuses).Error
+	if err != nil {
+		return err
+	}
+	if len(statuses) != len(uniqueIDs(j.DependsOn)) {
+		return jobinator.ErrJobNotFound
+	}
+	j.Status = backend.DependencyStatus(statuses)
+	if j.Status == status.Failed {
+		j.Error = jobinator.ErrDependencyFailed.Error()
+		j.FinishedAt = time.Now().Unix()
+	}
+	for _, x := range uniqueIDs(j.DependsOn) {
+		err := db.Create(&JobDependency{
+			JobID:     j.ID,
+			DependsOn: x,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, x := range ids {
+		if !seen[x] {
+			seen[x] = true
+			unique = append(unique, x)
+		}
+	}
+	return unique
+}
+
+//resolveDependents updates the jobs waiting for a job that has just finished. Jobs that fail because of it fail their own dependents in turn. Jobs depended on that no longer exist are assumed to be done, since only finished jobs are cleaned up and failed ones have already failed their dependents.
+func resolveDependents(db *gorm.DB, id string) error {
+	var dependents []string
+	err := db.Model(&JobDependency{}).Joins("JOIN jobs ON jobs.id = job_dependencies.job_id").Where("job_dependencies.depends_on = ? AND jobs.status = ?", id, status.Waiting).Pluck("job_dependencies.job_id", &dependents).Error
+	if err != nil {
+		return err
+	}
+	for _, x := range dependents {
+		err := updateDependencyStatus(db, x, status.Waiting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//updateDependencyStatus sets the status of a job that still has status from to the status of the jobs it depends on, see jobinator.DependencyStatus. If it fails because of them, it fails its own dependents in turn.
+func updateDependencyStatus(db *gorm.DB, id string, from int) error {
+	var statuses []int
+	err := db.Model(&jobinator.Job{}).Joins("JOIN job_dependencies ON jobs.id = job_dependencies.depends_on").Where("job_dependencies.job_id = ?", id).Pluck("jobs.status", &statuses).Error
+	if err != nil {
+		return err
+	}
+	s := backend.DependencyStatus(statuses)
+	if s == from {
+		return nil
+	}
+	updates := map[string]interface{}{
+		"status": s,
+	}
+	if s == status.Failed {
+		updates["error"] = jobinator.ErrDependencyFailed.Error()
+		updates["finished_at"] = time.Now().Unix()
+	}
+	res := db.Model(&jobinator.Job{}).Where("id = ? AND status = ?", id, from).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if s == status.Failed && res.RowsAffected > 0 {
+		return jobFinished(db, id)
+	}
+	return nil
+}
+
+//loadDependencies fills in the DependsOn list of the jobs.
+func loadDependencies(db *gorm.DB, jobs ...*jobinator.Job) error {
+	for _, j := range jobs {
+		var ids []string
+		err := db.Model(&JobDependency{}).Where("job_id = ?", j.ID).Pluck("depends_on", &ids).Error
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			j.DependsOn = ids
+		}
+	}
+	return nil
+}
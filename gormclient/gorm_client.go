@@ -1,27 +1,46 @@
 package gormclient
 
 import (
+	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
 	"github.com/blasphemy/jobinator/status"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite" //needed for sqlite support
 )
 
+//unfinishedStatuses are the statuses of jobs that can still be cancelled
+var unfinishedStatuses = []int{status.Pending, status.Retry, status.Running, status.Waiting}
+
+//failedStatuses are the statuses of jobs that can be retried manually
+var failedStatuses = []int{status.Failed, status.Timeout}
+
+//finishedStatuses are the statuses of jobs that won't run again
+var finishedStatuses = []int{status.Done, status.Failed, status.Timeout, status.Cancelled}
+
+//readyStatuses are the statuses of jobs that are waiting to run once their next_run has passed
+var readyStatuses = []int{status.Pending, status.Retry}
+
 //GormClient represents a client using a Gorm backend (SQL)
 type GormClient struct {
 	db     *gorm.DB
 	wfList []string
+	limits map[string]int //MaxConcurrency per worker name
+	rates  map[string]jobinator.RateLimit
 }
 
 //NewExistingGormClient is like NewGormClient(), except instead of adding connection params, it uses an existing gorm handle.
 func NewExistingGormClient(db *gorm.DB, config jobinator.ClientConfig) (*jobinator.Client, error) {
-	db.AutoMigrate(&jobinator.Job{})
+	db.AutoMigrate(&jobinator.Job{}, &JobDependency{}, &jobinator.Batch{}, &RateLimitBucket{}, &ConcurrencyLock{})
 	newgc := &GormClient{
 		db:     db,
 		wfList: []string{},
+		limits: make(map[string]int),
+		rates:  make(map[string]jobinator.RateLimit),
 	}
 	newc := jobinator.NewClient(newgc, config)
 	return newc, nil
@@ -30,72 +49,305 @@ func NewExistingGormClient(db *gorm.DB, config jobinator.ClientConfig) (*jobinat
 //NewGormClient returns a new *Client backed by gorm. It requires a driver type and connection string, as well as a ClientConfig.
 func NewGormClient(dbtype string, dbconn string, config jobinator.ClientConfig) (*jobinator.Client, error) {
 	db, err := gorm.Open(dbtype, dbconn)
-	db.AutoMigrate(&jobinator.Job{})
+	db.AutoMigrate(&jobinator.Job{}, &JobDependency{}, &jobinator.Batch{}, &RateLimitBucket{}, &ConcurrencyLock{})
 	if err != nil {
 		return nil, err
 	}
 	newgc := &GormClient{
 		db:     db,
 		wfList: []string{},
+		limits: make(map[string]int),
+		rates:  make(map[string]jobinator.RateLimit),
 	}
 	newc := jobinator.NewClient(newgc, config)
 	return newc, nil
 }
 
 //InternalRegisterWorker adds a worker to the list of registered workers for the internal client. This allows it to determine which jobs this node can execute.
-func (c *GormClient) InternalRegisterWorker(name string, wf jobinator.WorkerFunc) {
+func (c *GormClient) InternalRegisterWorker(name string, wf jobinator.WorkerFunc, config jobinator.WorkerConfig) {
 	c.wfList = append(c.wfList, name)
+	if config.MaxConcurrency > 0 {
+		c.limits[name] = config.MaxConcurrency
+	} else {
+		delete(c.limits, name)
+	}
+	if config.RateLimit.Limit > 0 {
+		c.rates[name] = config.RateLimit
+	} else {
+		delete(c.rates, name)
+	}
+}
+
+//InternalEnqueueJob queues up a job. It returns false if an existing named job was updated instead.
+func (c *GormClient) InternalEnqueueJob(j *jobinator.Job) (bool, error) {
+	if len(j.DependsOn) == 0 {
+		return enqueueJob(c.db, j)
+	}
+	//the job and its dependencies are inserted together
+	tx := c.db.Begin()
+	created, err := enqueueJob(tx, j)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return created, tx.Commit().Error
 }
 
-//InternalEnqueueJob queues up a job.
-func (c *GormClient) InternalEnqueueJob(j *jobinator.Job) error {
+//EnqueueJobTx queues up a job using the caller's transaction, so the job is only queued up if the transaction commits. The job is picked up by the next worker that looks for jobs, since there is no client to wake up workers. A Backoff.Func in the config is ignored, because it can only be kept by a client.
+func EnqueueJobTx(tx *gorm.DB, name string, args interface{}, config jobinator.JobConfig) (jobinator.EnqueueResult, error) {
+	j, err := jobinator.NewJob(name, args, config)
+	if err != nil {
+		return jobinator.EnqueueResult{}, err
+	}
+	created, err := enqueueJob(tx, j)
+	if err != nil {
+		return jobinator.EnqueueResult{}, err
+	}
+	return jobinator.EnqueueResult{
+		ID:      j.ID,
+		Created: created,
+	}, nil
+}
+
+//InternalEnqueueJobs queues up all the jobs in one transaction. Jobs that aren't named are inserted with multi-row inserts.
+func (c *GormClient) InternalEnqueueJobs(jobs []*jobinator.Job) ([]bool, error) {
+	created := make([]bool, len(jobs))
+	tx := c.db.Begin()
+	insert := []*jobinator.Job{}
+	for i, x := range jobs {
+		if bulkInsertable(x) {
+			insert = append(insert, x)
+			created[i] = true
+			continue
+		}
+		var err error
+		created[i], err = enqueueJob(tx, x)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err := insertJobs(tx, insert)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+//bulkInsertable returns whether the job can simply be inserted, without looking at other rows first.
+func bulkInsertable(j *jobinator.Job) bool {
+	return j.NamedJob == "" && len(j.DependsOn) == 0 && j.UniqueKey == nil
+}
+
+//maxBulkVariables keeps multi-row inserts below the number of variables sqlite allows in a single statement
+const maxBulkVariables = 999
+
+//insertJobs inserts the jobs with as few statements as possible. Gorm only inserts one row at a time, so the statements are built from the fields gorm would insert.
+func insertJobs(db *gorm.DB, jobs []*jobinator.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	scope := db.NewScope(&jobinator.Job{})
+	columns := []string{}
+	for _, x := range scope.Fields() {
+		if x.IsNormal && !x.IsIgnored {
+			columns = append(columns, scope.Quote(x.DBName))
+		}
+	}
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	chunk := maxBulkVariables / len(columns)
+	for start := 0; start < len(jobs); start += chunk {
+		end := start + chunk
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+		rows := []string{}
+		values := []interface{}{}
+		for _, j := range jobs[start:end] {
+			rows = append(rows, placeholders)
+			for _, x := range db.NewScope(j).Fields() {
+				if x.IsNormal && !x.IsIgnored {
+					values = append(values, x.Field.Interface())
+				}
+			}
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", scope.QuotedTableName(), strings.Join(columns, ","), strings.Join(rows, ","))
+		err := db.Exec(query, values...).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//enqueueJob is InternalEnqueueJob using db, which may be a transaction.
+func enqueueJob(db *gorm.DB, j *jobinator.Job) (bool, error) {
 	if j.NamedJob != "" {
 		//this is a named job. let's see if we can find it
 		ej := &jobinator.Job{}
-		nf := c.db.First(ej, "named_job = ?", j.NamedJob).RecordNotFound()
+		nf := db.First(ej, "named_job = ?", j.NamedJob).RecordNotFound()
 		if !nf { //found
-			updates := &jobinator.Job{
-				Args:           j.Args,
-				MaxRetry:       j.MaxRetry,
-				Repeat:         j.Repeat,
-				RepeatInterval: j.RepeatInterval,
-				Name:           j.Name,
+			nextRun := j.NextRun
+			if j.Repeat && j.Cron == "" {
+				nextRun = ej.FinishedAt + int64(j.RepeatInterval.Seconds())
 			}
-			if j.Repeat {
-				updates.NextRun = ej.FinishedAt + int64(j.RepeatInterval.Seconds())
+			//a map is used because zero values in a struct are skipped by Updates, and they have to overwrite the old settings
+			err := db.Model(ej).Updates(map[string]interface{}{
+				"args":              j.Args,
+				"max_retry":         j.MaxRetry,
+				"repeat":            j.Repeat,
+				"repeat_interval":   j.RepeatInterval,
+				"name":              j.Name,
+				"timeout":           j.Timeout,
+				"backoff_strategy":  j.BackoffStrategy,
+				"backoff_delay":     j.BackoffDelay,
+				"backoff_max_delay": j.BackoffMaxDelay,
+				"backoff_jitter":    j.BackoffJitter,
+				"cron":              j.Cron,
+				"queue":             j.Queue,
+				"priority":          j.Priority,
+				"next_run":          nextRun,
+			}).Error
+			if err != nil {
+				return false, err
 			}
-			err := c.db.Model(ej).Update(updates).Error
-			return err
+			j.ID = ej.ID
+			return false, nil
 		}
 	}
-	err := c.db.Create(j).Error
-	return err
+	if len(j.DependsOn) > 0 {
+		err := insertDependencies(db, j)
+		if err != nil {
+			return false, err
+		}
+	}
+	if j.UniqueKey != nil {
+		//the unique index can only reject the job if jobs that no longer hold the key give it up first
+		err := db.Model(&jobinator.Job{}).Where("unique_key = ? AND status in (?) AND unique_until <= ?", *j.UniqueKey, finishedStatuses, time.Now().Unix()).Update("unique_key", gorm.Expr("NULL")).Error
+		if err != nil {
+			return false, err
+		}
+	}
+	err := createJob(db, j)
+	if err != nil {
+		if j.UniqueKey != nil {
+			count := 0
+			cerr := db.Model(&jobinator.Job{}).Where("unique_key = ?", *j.UniqueKey).Count(&count).Error
+			if cerr == nil && count > 0 {
+				return false, jobinator.ErrDuplicateJob
+			}
+		}
+		return false, err
+	}
+	if status.Finished(j.Status) {
+		//the job failed because of a job it depends on
+		err := jobFinished(db, j.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//uniqueSavepoint is the savepoint createJob rolls back to when the insert of a unique job fails
+const uniqueSavepoint = "jobinator_unique_job"
+
+//createJob inserts the job. Some databases, like Postgres, abort the whole transaction when an insert fails, so inside a transaction the insert of a unique job is wrapped in a savepoint. That way a duplicate job can be detected afterwards and the transaction can still be used.
+func createJob(db *gorm.DB, j *jobinator.Job) error {
+	_, inTx := db.CommonDB().(*sql.Tx)
+	if j.UniqueKey == nil || !inTx {
+		return db.Create(j).Error
+	}
+	err := db.Exec("SAVEPOINT " + uniqueSavepoint).Error
+	if err != nil {
+		return err
+	}
+	err = db.Create(j).Error
+	if err != nil {
+		rerr := db.Exec("ROLLBACK TO SAVEPOINT " + uniqueSavepoint).Error
+		if rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return db.Exec("RELEASE SAVEPOINT " + uniqueSavepoint).Error
 }
 
 //InternalSelectJob selects a job from the database and marks it as in progress.
-func (c *GormClient) InternalSelectJob() (*jobinator.Job, error) {
+func (c *GormClient) InternalSelectJob(sc jobinator.SelectConfig) (*jobinator.Job, error) {
 	defer func() {
 		r := recover()
 		if r != nil {
 			fmt.Println("Recovering from panic in InternalSelectJob()")
 		}
 	}()
+	tx := c.db.Begin()
+	full, err := fullWorkers(tx, c.limits, sc.Abandoned)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	start := time.Now()
+	empty, buckets, err := rateLimitBuckets(tx, c.rates, start)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	wf := []string{}
 	for _, x := range c.wfList {
-		wf = append(wf, x)
+		if !full[x] && !empty[x] {
+			wf = append(wf, x)
+		}
 	}
-	tx := c.db.Begin()
 	j := &jobinator.Job{}
-	err := tx.Order("finished_at asc").First(j, "status = ? OR (status = ? AND (repeat = false) OR (repeat = true AND ? >= next_run)) AND name in (?)", status.Retry, status.Pending, time.Now().Unix(), wf).Error
+	now := start.Unix()
+	q := tx.Where("name in (?) AND status in (?) AND ? >= next_run", wf, readyStatuses, now)
+	if len(sc.Queues) > 0 {
+		q = q.Where("queue in (?)", sc.Queues)
+	}
+	err = q.Order("priority desc, enqueued_at asc").First(j).Error
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
-	err = tx.Model(j).Update("status", status.Running).Error
+	if limit, ok := c.limits[j.Name]; ok {
+		err = checkConcurrency(tx, j.Name, limit, sc.Abandoned[j.Name])
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if limit, ok := c.rates[j.Name]; ok {
+		err = takeToken(tx, j.Name, limit, buckets[j.Name], start)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	var leaseExpiresAt int64
+	if sc.LeaseDuration > 0 {
+		leaseExpiresAt = time.Now().Add(sc.LeaseDuration).Unix()
+	}
+	startedAt := time.Now().Unix()
+	err = tx.Model(j).Updates(map[string]interface{}{
+		"status":           status.Running,
+		"started_at":       startedAt,
+		"locked_by":        sc.WorkerID,
+		"lease_expires_at": leaseExpiresAt,
+	}).Error
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
+	j.Status = status.Running
+	j.StartedAt = startedAt
+	j.LockedBy = sc.WorkerID
+	j.LeaseExpiresAt = leaseExpiresAt
 	err = tx.Commit().Error
 	if err != nil {
 		return nil, err
@@ -103,16 +355,52 @@ func (c *GormClient) InternalSelectJob() (*jobinator.Job, error) {
 	return j, nil
 }
 
-//SetStatus sets the status for the job. See jobinator/status package for more info
-func (c *GormClient) SetStatus(j *jobinator.Job, status int) error {
-	err := c.db.Model(j).Update("status", status).Error
-	return err
+//fullWorkers returns the names of workers that are running as many jobs as their MaxConcurrency allows. Running jobs are counted across all processes sharing the database, abandoned jobs only in this one. The count isn't locked, so it only keeps full workers out of the search; checkConcurrency makes sure of the limit for the selected job.
+func fullWorkers(db *gorm.DB, limits map[string]int, abandoned map[string]int) (map[string]bool, error) {
+	full := map[string]bool{}
+	if len(limits) == 0 {
+		return full, nil
+	}
+	names := []string{}
+	for x := range limits {
+		names = append(names, x)
+	}
+	var running []struct {
+		Name  string
+		Count int
+	}
+	err := db.Model(&jobinator.Job{}).Select("name, count(*) as count").Where("status = ? AND name in (?)", status.Running, names).Group("name").Scan(&running).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for k, v := range abandoned {
+		counts[k] += v
+	}
+	for _, x := range running {
+		counts[x.Name] += x.Count
+	}
+	for name, limit := range limits {
+		if counts[name] >= limit {
+			full[name] = true
+		}
+	}
+	return full, nil
+}
+
+//SetStatus sets the status for the job. See jobinator/status package for more info. Cancelled jobs keep their status.
+func (c *GormClient) SetStatus(j *jobinator.Job, s int) error {
+	res := c.db.Model(j).Where("status <> ?", status.Cancelled).Update("status", s)
+	if res.Error != nil || res.RowsAffected == 0 || !status.Finished(s) {
+		return res.Error
+	}
+	return jobFinished(c.db, j.ID)
 }
 
-//InternalPendingJobs returns all pending jobs
+//InternalPendingJobs returns all jobs that are waiting to run and due
 func (c *GormClient) InternalPendingJobs() ([]*jobinator.Job, error) {
 	var j []*jobinator.Job
-	err := c.db.Find(&j, "status = ? OR (status = ? AND (repeat = false) OR (repeat = true AND ? >= next_run))", status.Retry, status.Pending, time.Now().Unix()).Error
+	err := c.db.Find(&j, "status in (?) AND ? >= next_run", readyStatuses, time.Now().Unix()).Error
 	if err != nil {
 		return []*jobinator.Job{}, err
 	}
@@ -138,6 +426,12 @@ func (c *GormClient) SetFinishedAt(j *jobinator.Job, t int64) error {
 	return err
 }
 
+//SetResult stores the result set by the job's worker
+func (c *GormClient) SetResult(j *jobinator.Job, result []byte) error {
+	err := c.db.Model(j).Update("result", result).Error
+	return err
+}
+
 //SetNextRun updates the next run field of the job
 func (c *GormClient) SetNextRun(j *jobinator.Job, t int64) error {
 	err := c.db.Model(j).Update("next_run", t).Error
@@ -148,11 +442,21 @@ func (c *GormClient) SetNextRun(j *jobinator.Job, t int64) error {
 func (c *GormClient) InternalCleanup(config jobinator.CleanUpConfig) error {
 	statuses := []int{
 		status.Done,
+		status.Cancelled,
 	}
 	if config.IncludeFailed {
-		statuses = append(statuses, status.Failed)
+		statuses = append(statuses, status.Failed, status.Timeout)
 	}
-	return c.db.Delete(&jobinator.Job{}, "status in (?) AND ? > (finished_at + ?)", statuses, time.Now().Unix(), int64(config.MaxAge.Seconds())).Error
+	err := c.db.Delete(&jobinator.Job{}, "status in (?) AND ? > (finished_at + ?)", statuses, time.Now().Unix(), int64(config.MaxAge.Seconds())).Error
+	if err != nil {
+		return err
+	}
+	err = c.db.Delete(&JobDependency{}, "job_id NOT IN (SELECT id FROM jobs)").Error
+	if err != nil {
+		return err
+	}
+	//batches are kept until their callback job has finished, so it can still look them up
+	return c.db.Delete(&jobinator.Batch{}, "finished_at > 0 AND ? > (finished_at + ?) AND callback_job_id NOT IN (SELECT id FROM jobs WHERE status in (?))", time.Now().Unix(), int64(config.MaxAge.Seconds()), unfinishedStatuses).Error
 }
 
 func (c *GormClient) GetNamedJob(name string) (*jobinator.Job, error) {
@@ -163,3 +467,277 @@ func (c *GormClient) GetNamedJob(name string) (*jobinator.Job, error) {
 	}
 	return j, nil
 }
+
+//RenewLease extends the lease of a running job, as long as it is still locked by the worker.
+func (c *GormClient) RenewLease(j *jobinator.Job, workerID string, expiresAt int64) error {
+	res := c.db.Model(&jobinator.Job{}).Where("id = ? AND status = ? AND locked_by = ?", j.ID, status.Running, workerID).Update("lease_expires_at", expiresAt)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return jobinator.ErrLeaseLost
+	}
+	j.LeaseExpiresAt = expiresAt
+	return nil
+}
+
+//InternalReapExpiredJobs requeues running jobs whose lease has expired, or fails them if they are out of retries.
+func (c *GormClient) InternalReapExpiredJobs() (int, error) {
+	expired := "status = ? AND lease_expires_at > 0 AND lease_expires_at < ?"
+	now := time.Now().Unix()
+	tx := c.db.Begin()
+	reaped := 0
+	var failed []string
+	err := tx.Model(&jobinator.Job{}).Where(expired+" AND retry_count >= max_retry", status.Running, now).Pluck("id", &failed).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	//jobs out of retries have to be failed first, otherwise they would be picked up by the requeue below
+	for _, x := range []struct {
+		cond   string
+		status int
+	}{
+		{expired + " AND retry_count >= max_retry", status.Failed},
+		{expired, status.Retry},
+	} {
+		updates := map[string]interface{}{
+			"status":      x.status,
+			"retry_count": gorm.Expr("retry_count + ?", 1),
+			"error":       jobinator.ErrLeaseExpired.Error(),
+			"error_stack": "",
+		}
+		if x.status == status.Failed {
+			updates["finished_at"] = now
+		}
+		res := tx.Model(&jobinator.Job{}).Where(x.cond, status.Running, now).Updates(updates)
+		if res.Error != nil {
+			tx.Rollback()
+			return 0, res.Error
+		}
+		reaped += int(res.RowsAffected)
+	}
+	for _, x := range failed {
+		err := jobFinished(tx, x)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return 0, err
+	}
+	return reaped, nil
+}
+
+//notUpdated is called when a job couldn't be updated because of its status. It returns ErrJobNotFound if the job doesn't exist, and err otherwise.
+func (c *GormClient) notUpdated(id string, err error) error {
+	count := 0
+	cerr := c.db.Model(&jobinator.Job{}).Where("id = ?", id).Count(&count).Error
+	if cerr != nil {
+		return cerr
+	}
+	if count == 0 {
+		return jobinator.ErrJobNotFound
+	}
+	return err
+}
+
+//InternalCancelJob marks a job that hasn't finished yet as cancelled.
+func (c *GormClient) InternalCancelJob(id string) error {
+	res := c.db.Model(&jobinator.Job{}).Where("id = ? AND status in (?)", id, unfinishedStatuses).Updates(map[string]interface{}{
+		"status":      status.Cancelled,
+		"finished_at": time.Now().Unix(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return c.notUpdated(id, jobinator.ErrJobFinished)
+	}
+	return jobFinished(c.db, id)
+}
+
+//InternalCancelNamedJob is like InternalCancelJob, for a named job. It returns the ID of the job.
+func (c *GormClient) InternalCancelNamedJob(name string) (string, error) {
+	j := &jobinator.Job{}
+	q := c.db.Select("id").First(j, "named_job = ?", name)
+	if q.RecordNotFound() {
+		return "", jobinator.ErrJobNotFound
+	}
+	if q.Error != nil {
+		return "", q.Error
+	}
+	return j.ID, c.InternalCancelJob(j.ID)
+}
+
+//retryUpdates resets a job so it runs again as if it had just been enqueued
+func retryUpdates() map[string]interface{} {
+	return map[string]interface{}{
+		"status":           status.Pending,
+		"retry_count":      0,
+		"error":            "",
+		"error_stack":      "",
+		"next_run":         time.Now().Unix(),
+		"locked_by":        "",
+		"lease_expires_at": 0,
+	}
+}
+
+//filterJobs narrows down a query to the jobs matching the filter
+func filterJobs(db *gorm.DB, filter jobinator.JobFilter) *gorm.DB {
+	if filter.Name != "" {
+		db = db.Where("name = ?", filter.Name)
+	}
+	if filter.Queue != "" {
+		db = db.Where("queue = ?", filter.Queue)
+	}
+	if filter.NamedJob != "" {
+		db = db.Where("named_job = ?", filter.NamedJob)
+	}
+	if len(filter.Statuses) > 0 {
+		db = db.Where("status in (?)", filter.Statuses)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		db = db.Where("created_at > ?", filter.CreatedAfter.Unix())
+	}
+	if !filter.CreatedBefore.IsZero() {
+		db = db.Where("created_at < ?", filter.CreatedBefore.Unix())
+	}
+	if !filter.FinishedAfter.IsZero() {
+		db = db.Where("finished_at > ?", filter.FinishedAfter.Unix())
+	}
+	if !filter.FinishedBefore.IsZero() {
+		db = db.Where("finished_at > 0 AND finished_at < ?", filter.FinishedBefore.Unix())
+	}
+	return db
+}
+
+//InternalRetryJob resets a failed or timed out job and puts it back into the queue.
+func (c *GormClient) InternalRetryJob(id string) error {
+	tx := c.db.Begin()
+	n, err := retryJobs(tx, tx.Model(&jobinator.Job{}).Where("id = ? AND status in (?)", id, failedStatuses))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return c.notUpdated(id, jobinator.ErrJobNotFailed)
+	}
+	return tx.Commit().Error
+}
+
+//InternalRetryFailed is like InternalRetryJob, for every failed or timed out job matching the filter.
+func (c *GormClient) InternalRetryFailed(filter jobinator.JobFilter) (int, error) {
+	tx := c.db.Begin()
+	n, err := retryJobs(tx, filterJobs(tx.Model(&jobinator.Job{}), filter).Where("status in (?)", failedStatuses))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+//retryJobs resets the failed or timed out jobs matched by q and returns how many there were. Jobs of batches are no longer counted as finished. Jobs are reset before their dependencies are checked, so jobs retried together with the jobs they depend on wait for them.
+func retryJobs(db *gorm.DB, q *gorm.DB) (int, error) {
+	var members []*jobinator.Job
+	err := q.Where("batch_id <> ''").Select("id, batch_id").Find(&members).Error
+	if err != nil {
+		return 0, err
+	}
+	var dependents []string
+	err = q.Where("id IN (SELECT job_id FROM job_dependencies)").Pluck("id", &dependents).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, x := range members {
+		err := batchJobRetried(db, x)
+		if err != nil {
+			return 0, err
+		}
+	}
+	res := q.Updates(retryUpdates())
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	for _, x := range dependents {
+		err := updateDependencyStatus(db, x, status.Pending)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int(res.RowsAffected), nil
+}
+
+//InternalGetJob returns the job with the given ID.
+func (c *GormClient) InternalGetJob(id string) (*jobinator.Job, error) {
+	j := &jobinator.Job{}
+	q := c.db.First(j, "id = ?", id)
+	if q.RecordNotFound() {
+		return nil, jobinator.ErrJobNotFound
+	}
+	if q.Error != nil {
+		return nil, q.Error
+	}
+	err := loadDependencies(c.db, j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+//InternalListJobs returns the jobs matching the query.
+func (c *GormClient) InternalListJobs(lq jobinator.ListQuery) ([]*jobinator.Job, error) {
+	q := filterJobs(c.db, lq.Filter)
+	if lq.AfterID != "" {
+		q = q.Where("created_at < ? OR (created_at = ? AND id < ?)", lq.AfterCreatedAt, lq.AfterCreatedAt, lq.AfterID)
+	}
+	var j []*jobinator.Job
+	err := q.Order("created_at desc, id desc").Limit(lq.Limit).Find(&j).Error
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+//InternalStats counts jobs with GROUP BY, so no job rows have to be loaded.
+func (c *GormClient) InternalStats() (jobinator.Stats, error) {
+	s := jobinator.Stats{}
+	var counts []struct {
+		Name   string
+		Queue  string
+		Status int
+		Count  int
+	}
+	err := c.db.Model(&jobinator.Job{}).Select("name, queue, status, count(*) as count").Group("name, queue, status").Scan(&counts).Error
+	if err != nil {
+		return s, err
+	}
+	for _, x := range counts {
+		backend.AddCount(&s, x.Name, x.Queue, x.Status, x.Count)
+	}
+	now := time.Now().Unix()
+	var oldest sql.NullInt64
+	err = c.db.Model(&jobinator.Job{}).Where("status in (?) AND ? >= next_run", readyStatuses, now).Select("min(CASE WHEN next_run > created_at THEN next_run ELSE created_at END)").Row().Scan(&oldest)
+	if err != nil {
+		return s, err
+	}
+	if oldest.Valid {
+		s.OldestPending = time.Duration(now-oldest.Int64) * time.Second
+	}
+	var avg sql.NullFloat64
+	err = c.db.Model(&jobinator.Job{}).Where("status = ? AND started_at > 0", status.Done).Select("avg(finished_at - started_at)").Row().Scan(&avg)
+	if err != nil {
+		return s, err
+	}
+	if avg.Valid {
+		s.AverageRunTime = time.Duration(avg.Float64 * float64(time.Second))
+	}
+	return s, nil
+}
@@ -1,14 +1,19 @@
 package gormclient
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/status"
 )
 
 var g *jobinator.Client
@@ -114,7 +119,8 @@ func TestRepeatingJob(t *testing.T) {
 	})
 	g.NewBackgroundWorker()
 	g.StartAllWorkers()
-	time.Sleep(time.Second * 6)
+	//the job is due after a second and the idle worker looks for it every two seconds, so it runs after two, four and six seconds
+	time.Sleep(time.Second * 7)
 	g.DestroyAllWorkers()
 	assert.Equal(t, 3, td["repeater"])
 }
@@ -129,3 +135,754 @@ func TestEnqueueNamedJob(t *testing.T) {
 	})
 	assert.Nil(t, err)
 }
+
+func TestEnqueueNamedJobClearsSettings(t *testing.T) {
+	err := g.EnqueueJob("whatever", nil, jobinator.JobConfig{
+		Identifier: "named_job2",
+		Cron:       "0 * * * *",
+		Priority:   5,
+		Timeout:    time.Minute,
+		MaxRetry:   3,
+		Backoff: jobinator.Backoff{
+			Strategy: jobinator.BackoffExponential,
+			Delay:    time.Second,
+			Jitter:   true,
+		},
+	})
+	assert.Nil(t, err)
+	//settings that are zero in the new config overwrite the old ones, like they do in memory
+	err = g.EnqueueJob("whatever", nil, jobinator.JobConfig{
+		Identifier:     "named_job2",
+		Repeat:         true,
+		RepeatInterval: time.Hour,
+	})
+	assert.Nil(t, err)
+	j, err := g.GetNamedJob("named_job2")
+	assert.Nil(t, err)
+	assert.Equal(t, "", j.Cron)
+	assert.Equal(t, 0, j.Priority)
+	assert.Equal(t, time.Duration(0), j.Timeout)
+	assert.Equal(t, 0, j.MaxRetry)
+	assert.Equal(t, jobinator.BackoffNone, j.BackoffStrategy)
+	assert.Equal(t, time.Duration(0), j.BackoffDelay)
+	assert.False(t, j.BackoffJitter)
+	assert.Equal(t, time.Hour, j.RepeatInterval)
+}
+
+func TestScheduledJobNotPending(t *testing.T) {
+	before, err := g.PendingJobs()
+	assert.Nil(t, err)
+	err = g.EnqueueJob("willNotExecute", nil, jobinator.JobConfig{
+		RunIn: time.Hour,
+	})
+	assert.Nil(t, err)
+	after, err := g.PendingJobs()
+	assert.Nil(t, err)
+	assert.Equal(t, len(before), len(after))
+}
+
+func TestQueues(t *testing.T) {
+	td["critical"] = 0
+	td["bulk"] = 0
+	for _, name := range []string{"critical", "bulk"} {
+		name := name
+		g.RegisterWorker(name, func(j *jobinator.JobRef) error {
+			tdLock.Lock()
+			td[name]++
+			tdLock.Unlock()
+			return nil
+		})
+		g.EnqueueJob(name, nil, jobinator.JobConfig{
+			Queue: name,
+		})
+	}
+	g.NewBackgroundWorker("critical")
+	g.StartAllWorkers()
+	time.Sleep(time.Second * 3)
+	g.DestroyAllWorkers()
+	tdLock.Lock()
+	assert.Equal(t, 1, td["critical"])
+	assert.Equal(t, 0, td["bulk"])
+	tdLock.Unlock()
+}
+
+func TestPriority(t *testing.T) {
+	g.RegisterWorker("prio", func(j *jobinator.JobRef) error {
+		return nil
+	})
+	for _, p := range []int{0, 5, 1} {
+		g.EnqueueJob("prio", p, jobinator.JobConfig{
+			Queue:    "prio",
+			Priority: p,
+		})
+	}
+	order := []int{}
+	for i := 0; i < 3; i++ {
+		j, err := g.InternalSelectJob(jobinator.SelectConfig{
+			Queues: []string{"prio"},
+		})
+		assert.Nil(t, err)
+		order = append(order, j.Priority)
+	}
+	assert.Equal(t, []int{5, 1, 0}, order)
+}
+
+func TestSamePriorityFIFO(t *testing.T) {
+	g.RegisterWorker("fifo", func(j *jobinator.JobRef) error {
+		return nil
+	})
+	//jobs enqueued within the same second have to run in order, whether they are enqueued one by one or together
+	for i := 0; i < 10; i++ {
+		_, err := g.Enqueue("fifo", i, jobinator.JobConfig{
+			Queue: "fifo",
+		})
+		assert.Nil(t, err)
+	}
+	specs := []jobinator.JobSpec{}
+	for i := 10; i < 20; i++ {
+		specs = append(specs, jobinator.JobSpec{
+			Name: "fifo",
+			Args: i,
+			Config: jobinator.JobConfig{
+				Queue: "fifo",
+			},
+		})
+	}
+	_, err := g.EnqueueJobs(specs)
+	assert.Nil(t, err)
+	order := []int{}
+	for i := 0; i < 20; i++ {
+		j, err := g.InternalSelectJob(jobinator.SelectConfig{
+			Queues: []string{"fifo"},
+		})
+		assert.Nil(t, err)
+		n := 0
+		assert.Nil(t, json.Unmarshal(j.Args, &n))
+		order = append(order, n)
+	}
+	expected := []int{}
+	for i := 0; i < 20; i++ {
+		expected = append(expected, i)
+	}
+	assert.Equal(t, expected, order)
+}
+
+func TestReapExpiredJobs(t *testing.T) {
+	for _, x := range []struct {
+		id       string
+		maxRetry int
+	}{
+		{"crashed", 1},
+		{"crashed_out_of_retries", 0},
+	} {
+		_, err := g.InternalEnqueueJob(&jobinator.Job{
+			ID:             x.id,
+			Name:           "crashed",
+			NamedJob:       x.id,
+			Status:         status.Running,
+			MaxRetry:       x.maxRetry,
+			LockedBy:       "dead worker",
+			LeaseExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		})
+		assert.Nil(t, err)
+	}
+	reaped, err := g.ReapExpiredJobs()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reaped)
+	j, err := g.GetNamedJob("crashed")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Retry, j.Status)
+	assert.Equal(t, 1, j.RetryCount)
+	assert.Equal(t, int64(0), j.FinishedAt)
+	err = g.RenewLease(j, "dead worker", time.Now().Unix())
+	assert.Equal(t, jobinator.ErrLeaseLost, err)
+	//a failed job keeps its finish time, so CleanUp only deletes it once it is old enough
+	j, err = g.GetNamedJob("crashed_out_of_retries")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	assert.True(t, j.FinishedAt >= time.Now().Add(-time.Minute).Unix())
+	err = g.CleanUp(jobinator.CleanUpConfig{
+		MaxAge:        time.Hour,
+		IncludeFailed: true,
+	})
+	assert.Nil(t, err)
+	_, err = g.GetJob("crashed_out_of_retries")
+	assert.Nil(t, err)
+}
+
+func TestCancelJob(t *testing.T) {
+	err := g.EnqueueJob("cancelled", nil, jobinator.JobConfig{
+		Identifier: "cancelled",
+	})
+	assert.Nil(t, err)
+	err = g.CancelNamedJob("cancelled")
+	assert.Nil(t, err)
+	j, err := g.GetNamedJob("cancelled")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Cancelled, j.Status)
+	err = g.SetStatus(j, status.Done)
+	assert.Nil(t, err)
+	j, err = g.GetNamedJob("cancelled")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Cancelled, j.Status)
+	err = g.CancelJob(j.ID)
+	assert.Equal(t, jobinator.ErrJobFinished, err)
+	err = g.CancelNamedJob("missing")
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+}
+
+func TestRetryFailed(t *testing.T) {
+	for i, s := range []int{status.Failed, status.Timeout, status.Done} {
+		_, err := g.InternalEnqueueJob(&jobinator.Job{
+			ID:         fmt.Sprintf("failed_%d", i),
+			Name:       "failed",
+			NamedJob:   fmt.Sprintf("failed_%d", i),
+			Status:     s,
+			RetryCount: 3,
+			MaxRetry:   2,
+			Error:      "downstream outage",
+		})
+		assert.Nil(t, err)
+	}
+	n, err := g.RetryAllFailed(jobinator.JobFilter{
+		Name: "failed",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	j, err := g.GetNamedJob("failed_1")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+	assert.Equal(t, 0, j.RetryCount)
+	assert.Equal(t, "", j.Error)
+	err = g.RetryJob(j.ID)
+	assert.Equal(t, jobinator.ErrJobNotFailed, err)
+	err = g.RetryJob("missing")
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+}
+
+func TestListJobs(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		err := g.EnqueueJob("list", nil, jobinator.JobConfig{
+			Queue: "list",
+		})
+		assert.Nil(t, err)
+	}
+	seen := map[string]bool{}
+	cursor := ""
+	pages := 0
+	for {
+		jobs, next, err := g.ListJobs(jobinator.ListConfig{
+			Filter: jobinator.JobFilter{
+				Name:     "list",
+				Statuses: []int{status.Pending},
+			},
+			Cursor: cursor,
+			Limit:  2,
+		})
+		assert.Nil(t, err)
+		pages++
+		for _, x := range jobs {
+			assert.False(t, seen[x.ID])
+			seen[x.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 5, len(seen))
+	assert.Equal(t, 3, pages)
+	for id := range seen {
+		j, err := g.GetJob(id)
+		assert.Nil(t, err)
+		assert.Equal(t, "list", j.Queue)
+	}
+	jobs, _, err := g.ListJobs(jobinator.ListConfig{
+		Filter: jobinator.JobFilter{
+			Name:     "list",
+			Statuses: []int{status.Failed},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, jobs)
+	_, err = g.GetJob("missing")
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+	_, _, err = g.ListJobs(jobinator.ListConfig{
+		Cursor: "invalid",
+	})
+	assert.Equal(t, jobinator.ErrInvalidCursor, err)
+}
+
+func TestStats(t *testing.T) {
+	now := time.Now().Unix()
+	for i, s := range []int{status.Pending, status.Pending, status.Done} {
+		_, err := g.InternalEnqueueJob(&jobinator.Job{
+			ID:        fmt.Sprintf("stats_%d", i),
+			Name:      "stats",
+			Queue:     "stats",
+			Status:    s,
+			CreatedAt: now - 3600,
+		})
+		assert.Nil(t, err)
+	}
+	s, err := g.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, s.Names["stats"].Total())
+	assert.Equal(t, 2, s.Names["stats"][status.Pending])
+	assert.Equal(t, 1, s.Queues["stats"][status.Done])
+	assert.True(t, s.Statuses.Total() >= 3)
+	assert.True(t, s.OldestPending >= time.Hour)
+}
+
+func TestJobResult(t *testing.T) {
+	type result struct {
+		Sum int
+	}
+	g.RegisterWorker("sum", func(j *jobinator.JobRef) error {
+		args := []int{}
+		err := j.ScanArgs(&args)
+		if err != nil {
+			return err
+		}
+		r := result{}
+		for _, x := range args {
+			r.Sum += x
+		}
+		return j.SetResult(r)
+	})
+	err := g.EnqueueJob("sum", []int{1, 2, 3}, jobinator.JobConfig{
+		Identifier: "sum",
+	})
+	assert.Nil(t, err)
+	g.NewBackgroundWorker()
+	g.StartAllWorkers()
+	time.Sleep(2 * time.Second)
+	g.DestroyAllWorkers()
+	j, err := g.GetNamedJob("sum")
+	assert.Nil(t, err)
+	j, err = g.GetJob(j.ID)
+	assert.Nil(t, err)
+	r := result{}
+	err = j.ScanResult(&r)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, r.Sum)
+	info, err := g.NamedJobInfo("sum")
+	assert.Nil(t, err)
+	assert.Equal(t, j.Result, info.Result)
+}
+
+func TestFuture(t *testing.T) {
+	f, err := g.EnqueueFuture("future", nil, jobinator.JobConfig{
+		Identifier: "future",
+		RunIn:      time.Hour,
+	})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/2)
+	defer cancel()
+	_, err = f.Wait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	go func() {
+		time.Sleep(time.Second / 2)
+		g.CancelJob(f.ID())
+	}()
+	_, err = f.Wait(context.Background())
+	assert.Equal(t, jobinator.ErrJobCancelled, err)
+}
+
+func TestEnqueueReturnsID(t *testing.T) {
+	first, err := g.Enqueue("id", nil, jobinator.JobConfig{
+		Identifier: "named_id",
+	})
+	assert.Nil(t, err)
+	assert.True(t, first.Created)
+	second, err := g.Enqueue("id", 1, jobinator.JobConfig{
+		Identifier: "named_id",
+	})
+	assert.Nil(t, err)
+	assert.False(t, second.Created)
+	assert.Equal(t, first.ID, second.ID)
+	j, err := g.GetJob(second.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(j.Args))
+}
+
+func TestEnqueueJobs(t *testing.T) {
+	specs := []jobinator.JobSpec{}
+	for i := 0; i < 100; i++ {
+		specs = append(specs, jobinator.JobSpec{
+			Name: "batch",
+			Args: i,
+			Config: jobinator.JobConfig{
+				Queue:    "batch",
+				Priority: i,
+				RunIn:    time.Hour,
+			},
+		})
+	}
+	specs = append(specs, jobinator.JobSpec{
+		Name: "batch",
+		Config: jobinator.JobConfig{
+			Identifier: "named_id",
+			Queue:      "batch",
+		},
+	})
+	results, err := g.EnqueueJobs(specs)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, len(results))
+	assert.False(t, results[100].Created)
+	j, err := g.GetJob(results[42].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", string(j.Args))
+	assert.Equal(t, 42, j.Priority)
+	assert.Equal(t, status.Pending, j.Status)
+	s, err := g.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 101, s.Names["batch"].Total())
+	assert.Equal(t, 101, s.Queues["batch"].Total())
+	_, err = g.InternalEnqueueJobs([]*jobinator.Job{
+		{ID: "batch_new", Name: "batch"},
+		{ID: results[0].ID, Name: "batch"},
+	})
+	assert.NotNil(t, err)
+	_, err = g.GetJob("batch_new")
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+}
+
+func TestEnqueueJobTx(t *testing.T) {
+	db := g.InternalClient.(*GormClient).db
+	tx := db.Begin()
+	rolledBack, err := EnqueueJobTx(tx, "tx", nil, jobinator.JobConfig{})
+	assert.Nil(t, err)
+	assert.True(t, rolledBack.Created)
+	tx.Rollback()
+	_, err = g.GetJob(rolledBack.ID)
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+	tx = db.Begin()
+	committed, err := EnqueueJobTx(tx, "tx", nil, jobinator.JobConfig{})
+	assert.Nil(t, err)
+	err = tx.Commit().Error
+	assert.Nil(t, err)
+	j, err := g.GetJob(committed.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "tx", j.Name)
+}
+
+func TestDependencies(t *testing.T) {
+	parent, err := g.Enqueue("parent", nil, jobinator.JobConfig{
+		RunIn: time.Hour,
+	})
+	assert.Nil(t, err)
+	child, err := g.Enqueue("child", nil, jobinator.JobConfig{
+		DependsOn: []string{parent.ID},
+	})
+	assert.Nil(t, err)
+	grandchild, err := g.Enqueue("child", nil, jobinator.JobConfig{
+		DependsOn: []string{child.ID},
+	})
+	assert.Nil(t, err)
+	j, err := g.GetJob(child.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Waiting, j.Status)
+	assert.Equal(t, []string{parent.ID}, j.DependsOn)
+	_, err = g.Enqueue("child", nil, jobinator.JobConfig{
+		DependsOn: []string{"missing"},
+	})
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+	err = g.CancelJob(parent.ID)
+	assert.Nil(t, err)
+	for _, x := range []string{child.ID, grandchild.ID} {
+		j, err := g.GetJob(x)
+		assert.Nil(t, err)
+		assert.Equal(t, status.Failed, j.Status)
+		assert.Equal(t, jobinator.ErrDependencyFailed.Error(), j.Error)
+	}
+	done, err := g.Enqueue("parent", nil, jobinator.JobConfig{
+		RunIn: time.Hour,
+	})
+	assert.Nil(t, err)
+	j, err = g.GetJob(done.ID)
+	assert.Nil(t, err)
+	waiting, err := g.Enqueue("child", nil, jobinator.JobConfig{
+		DependsOn: []string{done.ID},
+	})
+	assert.Nil(t, err)
+	err = g.SetStatus(j, status.Done)
+	assert.Nil(t, err)
+	j, err = g.GetJob(waiting.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+}
+
+func TestRetryWithDependencies(t *testing.T) {
+	config := jobinator.JobConfig{
+		Queue: "retry_deps",
+		RunIn: time.Hour,
+	}
+	parent, err := g.Enqueue("retry_parent", nil, config)
+	assert.Nil(t, err)
+	config.DependsOn = []string{parent.ID}
+	child, err := g.Enqueue("retry_child", nil, config)
+	assert.Nil(t, err)
+	j, err := g.GetJob(parent.ID)
+	assert.Nil(t, err)
+	err = g.SetStatus(j, status.Failed)
+	assert.Nil(t, err)
+	j, err = g.GetJob(child.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	//the child is retried together with its parent, so it has to wait for it again
+	n, err := g.RetryAllFailed(jobinator.JobFilter{
+		Queue: "retry_deps",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	j, err = g.GetJob(child.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Waiting, j.Status)
+	j, err = g.GetJob(parent.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+	err = g.SetStatus(j, status.Failed)
+	assert.Nil(t, err)
+	//retrying the child alone while its parent has failed fails it again right away
+	err = g.RetryJob(child.ID)
+	assert.Nil(t, err)
+	j, err = g.GetJob(child.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	assert.Equal(t, jobinator.ErrDependencyFailed.Error(), j.Error)
+}
+
+func TestBatchCallback(t *testing.T) {
+	var callbacks int32
+	g.RegisterWorker("batch_member", func(j *jobinator.JobRef) error {
+		return nil
+	})
+	g.RegisterWorker("batch_callback", func(j *jobinator.JobRef) error {
+		b, err := g.GetBatch(j.BatchID())
+		if err != nil {
+			return err
+		}
+		if b.Succeeded == 3 {
+			atomic.AddInt32(&callbacks, 1)
+		}
+		return nil
+	})
+	specs := []jobinator.JobSpec{}
+	for i := 0; i < 3; i++ {
+		specs = append(specs, jobinator.JobSpec{
+			Name: "batch_member",
+		})
+	}
+	b, _, err := g.EnqueueBatch(specs, jobinator.BatchConfig{
+		Callback: &jobinator.JobSpec{
+			Name: "batch_callback",
+		},
+	})
+	assert.Nil(t, err)
+	j, err := g.GetJob(b.CallbackJobID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Waiting, j.Status)
+	g.NewBackgroundWorker()
+	g.NewBackgroundWorker()
+	g.StartAllWorkers()
+	time.Sleep(3 * time.Second)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&callbacks))
+	b, err = g.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.True(t, b.Finished())
+	assert.Equal(t, 3, b.Succeeded)
+	_, _, err = g.EnqueueBatch([]jobinator.JobSpec{
+		{Name: "batch_member", Config: jobinator.JobConfig{Identifier: "batch"}},
+	}, jobinator.BatchConfig{})
+	assert.Equal(t, jobinator.ErrNamedJobInBatch, err)
+}
+
+func TestRetryBatchJob(t *testing.T) {
+	config := jobinator.JobConfig{
+		RunIn: time.Hour,
+	}
+	b, results, err := g.EnqueueBatch([]jobinator.JobSpec{
+		{Name: "batch_retry", Config: config},
+		{Name: "batch_retry", Config: config},
+	}, jobinator.BatchConfig{})
+	assert.Nil(t, err)
+	setStatus := func(id string, s int) {
+		j, err := g.GetJob(id)
+		assert.Nil(t, err)
+		assert.Nil(t, g.SetStatus(j, s))
+	}
+	setStatus(results[0].ID, status.Failed)
+	nb, err := g.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, nb.Failed)
+	//the retried job is counted again once it finishes, so its failure is taken back
+	err = g.RetryJob(results[0].ID)
+	assert.Nil(t, err)
+	nb, err = g.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, nb.Failed)
+	setStatus(results[0].ID, status.Done)
+	nb, err = g.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.False(t, nb.Finished())
+	assert.Equal(t, 1, nb.Succeeded)
+	setStatus(results[1].ID, status.Done)
+	nb, err = g.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.True(t, nb.Finished())
+	assert.Equal(t, 2, nb.Succeeded)
+	assert.Equal(t, 0, nb.Failed)
+}
+
+func TestBatchFinishedOnEnqueue(t *testing.T) {
+	parent, err := g.Enqueue("parent", nil, jobinator.JobConfig{
+		RunIn: time.Hour,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, g.CancelJob(parent.ID))
+	//the only job of the batch fails right away, so the batch finishes while it is queued up
+	b, _, err := g.EnqueueBatch([]jobinator.JobSpec{
+		{Name: "child", Config: jobinator.JobConfig{DependsOn: []string{parent.ID}}},
+	}, jobinator.BatchConfig{
+		Callback: &jobinator.JobSpec{
+			Name: "batch_callback",
+			Config: jobinator.JobConfig{
+				RunIn: time.Hour,
+			},
+		},
+	})
+	assert.Nil(t, err)
+	b, err = g.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.True(t, b.Finished())
+	assert.Equal(t, 1, b.Failed)
+	j, err := g.GetJob(b.CallbackJobID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+}
+
+func TestUniqueJobs(t *testing.T) {
+	config := jobinator.JobConfig{
+		Unique: &jobinator.Unique{},
+		RunIn:  time.Hour,
+	}
+	first, err := g.Enqueue("unique", 1, config)
+	assert.Nil(t, err)
+	_, err = g.Enqueue("unique", 1, config)
+	assert.Equal(t, jobinator.ErrDuplicateJob, err)
+	_, err = g.Enqueue("unique", 2, config)
+	assert.Nil(t, err)
+	j, err := g.GetJob(first.ID)
+	assert.Nil(t, err)
+	err = g.SetStatus(j, status.Done)
+	assert.Nil(t, err)
+	_, err = g.Enqueue("unique", 1, config)
+	assert.Nil(t, err)
+	windowed := jobinator.JobConfig{
+		Unique: &jobinator.Unique{
+			Key:    "unique_window",
+			Window: time.Hour,
+		},
+		RunIn: time.Hour,
+	}
+	res, err := g.Enqueue("unique", 3, windowed)
+	assert.Nil(t, err)
+	err = g.CancelJob(res.ID)
+	assert.Nil(t, err)
+	_, err = g.Enqueue("unique", 4, windowed)
+	assert.Equal(t, jobinator.ErrDuplicateJob, err)
+	_, err = g.EnqueueJobs([]jobinator.JobSpec{
+		{Name: "unique", Args: 5},
+		{Name: "unique", Args: 6, Config: windowed},
+	})
+	assert.Equal(t, jobinator.ErrDuplicateJob, err)
+	//a duplicate job doesn't break the caller's transaction
+	tx := g.InternalClient.(*GormClient).db.Begin()
+	inTx, err := EnqueueJobTx(tx, "unique", 7, config)
+	assert.Nil(t, err)
+	_, err = EnqueueJobTx(tx, "unique", 7, config)
+	assert.Equal(t, jobinator.ErrDuplicateJob, err)
+	afterDuplicate, err := EnqueueJobTx(tx, "unique", 8, config)
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit().Error)
+	for _, x := range []string{inTx.ID, afterDuplicate.ID} {
+		_, err = g.GetJob(x)
+		assert.Nil(t, err)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var running, maxRunning, done int32
+	g.RegisterWorkerWithConfig("limited", func(j *jobinator.JobRef) error {
+		n := atomic.AddInt32(&running, 1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		time.Sleep(time.Second / 5)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&done, 1)
+		return nil
+	}, jobinator.WorkerConfig{
+		MaxConcurrency: 1,
+	})
+	for i := 0; i < 3; i++ {
+		g.EnqueueJob("limited", nil, jobinator.JobConfig{})
+	}
+	for i := 0; i < 3; i++ {
+		g.NewBackgroundWorker()
+	}
+	g.StartAllWorkers()
+	time.Sleep(3 * time.Second)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&done))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+}
+
+func TestCheckConcurrency(t *testing.T) {
+	db := g.InternalClient.(*GormClient).db
+	//started by another process after fullWorkers counted the running jobs
+	_, err := g.InternalEnqueueJob(&jobinator.Job{
+		ID:     "concurrency_running",
+		Name:   "concurrency_checked",
+		Status: status.Running,
+	})
+	assert.Nil(t, err)
+	defer db.Delete(&jobinator.Job{}, "id = ?", "concurrency_running")
+	tx := db.Begin()
+	//the first check creates the worker's lock row
+	assert.Nil(t, checkConcurrency(tx, "concurrency_checked", 2, 0))
+	assert.Equal(t, errWorkerFull, checkConcurrency(tx, "concurrency_checked", 2, 1))
+	assert.Equal(t, errWorkerFull, checkConcurrency(tx, "concurrency_checked", 1, 0))
+	assert.Nil(t, tx.Commit().Error)
+	lock := &ConcurrencyLock{}
+	assert.Nil(t, db.First(lock, "name = ?", "concurrency_checked").Error)
+	assert.True(t, lock.LockedAt > 0)
+}
+
+func TestRateLimit(t *testing.T) {
+	var done int32
+	g.RegisterWorkerWithConfig("rate_limited", func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&done, 1)
+		return nil
+	}, jobinator.WorkerConfig{
+		RateLimit: jobinator.RateLimit{
+			Limit: 1,
+			Per:   time.Hour,
+		},
+	})
+	for i := 0; i < 3; i++ {
+		g.EnqueueJob("rate_limited", nil, jobinator.JobConfig{})
+	}
+	g.NewBackgroundWorker()
+	g.NewBackgroundWorker()
+	g.StartAllWorkers()
+	time.Sleep(2 * time.Second)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&done))
+	b := &RateLimitBucket{}
+	err := g.InternalClient.(*GormClient).db.First(b, "name = ?", "rate_limited").Error
+	assert.Nil(t, err)
+	assert.True(t, b.Tokens < 1)
+}
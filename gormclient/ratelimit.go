@@ -0,0 +1,68 @@
+package gormclient
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
+	"github.com/jinzhu/gorm"
+)
+
+//errTokenTaken is returned by InternalSelectJob when another process took the rate limit token the job would have used.
+var errTokenTaken = errors.New("rate limit token was taken by another worker")
+
+//RateLimitBucket is the token bucket of a rate limited worker, shared by all processes using the database.
+type RateLimitBucket struct {
+	Name       string `gorm:"primary_key"`
+	Tokens     float64
+	RefilledAt int64 //unix nanoseconds
+}
+
+//rateLimitBuckets loads the buckets of the rate limited workers and returns the names of the workers that are out of tokens. Buckets that don't exist yet are full and missing from the returned buckets.
+func rateLimitBuckets(db *gorm.DB, limits map[string]jobinator.RateLimit, now time.Time) (map[string]bool, map[string]*RateLimitBucket, error) {
+	empty := map[string]bool{}
+	buckets := map[string]*RateLimitBucket{}
+	if len(limits) == 0 {
+		return empty, buckets, nil
+	}
+	names := []string{}
+	for x := range limits {
+		names = append(names, x)
+	}
+	var found []*RateLimitBucket
+	err := db.Where("name in (?)", names).Find(&found).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, x := range found {
+		buckets[x.Name] = x
+		if backend.Refill(limits[x.Name], x.Tokens, now.Sub(time.Unix(0, x.RefilledAt))) < 1 {
+			empty[x.Name] = true
+		}
+	}
+	return empty, buckets, nil
+}
+
+//takeToken takes a token from the bucket of a rate limited worker. The bucket is only updated if no one else has updated it since it was loaded, so concurrent workers can't take the same token.
+func takeToken(db *gorm.DB, name string, limit jobinator.RateLimit, b *RateLimitBucket, now time.Time) error {
+	if b == nil {
+		return db.Create(&RateLimitBucket{
+			Name:       name,
+			Tokens:     backend.MaxTokens(limit) - 1,
+			RefilledAt: now.UnixNano(),
+		}).Error
+	}
+	tokens := backend.Refill(limit, b.Tokens, now.Sub(time.Unix(0, b.RefilledAt))) - 1
+	res := db.Model(&RateLimitBucket{}).Where("name = ? AND refilled_at = ?", name, b.RefilledAt).Updates(map[string]interface{}{
+		"tokens":      tokens,
+		"refilled_at": now.UnixNano(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errTokenTaken
+	}
+	return nil
+}
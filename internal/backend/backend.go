@@ -0,0 +1,155 @@
+//Package backend holds the rules storage backends share, so that jobs, batches and rate limits behave the same whichever backend stores them.
+package backend
+
+import (
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/status"
+)
+
+//BatchJobRetried takes back the count of a job of the batch that had finished with the given status and is run again. Once the batch has finished, its counts don't change anymore.
+func BatchJobRetried(b *jobinator.Batch, s int) {
+	if b.Finished() {
+		return
+	}
+	if s == status.Done {
+		b.Succeeded--
+	} else {
+		b.Failed--
+	}
+}
+
+//BatchJobFinished counts a job of the batch that has finished with the given status. It returns true if this was the last job of the batch, in which case its callback job has to be queued up.
+func BatchJobFinished(b *jobinator.Batch, s int) bool {
+	if b.Finished() {
+		return false
+	}
+	if s == status.Done {
+		b.Succeeded++
+	} else {
+		b.Failed++
+	}
+	if b.Succeeded+b.Failed < b.Total {
+		return false
+	}
+	b.FinishedAt = time.Now().Unix()
+	return true
+}
+
+//AddCount adds count jobs with the given name, queue and status to the stats.
+func AddCount(s *jobinator.Stats, name string, queue string, st int, count int) {
+	if s.Statuses == nil {
+		s.Statuses = jobinator.StatusCounts{}
+	}
+	if s.Names == nil {
+		s.Names = make(map[string]jobinator.StatusCounts)
+	}
+	if s.Queues == nil {
+		s.Queues = make(map[string]jobinator.StatusCounts)
+	}
+	if s.Names[name] == nil {
+		s.Names[name] = jobinator.StatusCounts{}
+	}
+	if s.Queues[queue] == nil {
+		s.Queues[queue] = jobinator.StatusCounts{}
+	}
+	s.Statuses[st] += count
+	s.Names[name][st] += count
+	s.Queues[queue][st] += count
+}
+
+//MaxTokens returns how many tokens the bucket of a rate limit holds when it is full.
+func MaxTokens(r jobinator.RateLimit) float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Limit)
+}
+
+//Refill returns how many tokens a bucket that had the given tokens holds after elapsed.
+func Refill(r jobinator.RateLimit, tokens float64, elapsed time.Duration) float64 {
+	per := r.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	if elapsed > 0 {
+		tokens += float64(r.Limit) * float64(elapsed) / float64(per)
+	}
+	if tokens > MaxTokens(r) {
+		return MaxTokens(r)
+	}
+	return tokens
+}
+
+//Matches returns whether the job matches the filter.
+func Matches(f jobinator.JobFilter, j *jobinator.Job) bool {
+	if f.Name != "" && j.Name != f.Name {
+		return false
+	}
+	if f.Queue != "" && j.Queue != f.Queue {
+		return false
+	}
+	if f.NamedJob != "" && j.NamedJob != f.NamedJob {
+		return false
+	}
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, x := range f.Statuses {
+			if j.Status == x {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.CreatedAfter.IsZero() && j.CreatedAt <= f.CreatedAfter.Unix() {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && j.CreatedAt >= f.CreatedBefore.Unix() {
+		return false
+	}
+	if !f.FinishedAfter.IsZero() && j.FinishedAt <= f.FinishedAfter.Unix() {
+		return false
+	}
+	if !f.FinishedBefore.IsZero() && (j.FinishedAt == 0 || j.FinishedAt >= f.FinishedBefore.Unix()) {
+		return false
+	}
+	return true
+}
+
+//ListsBefore returns whether a comes before b in a job listing, see jobinator.ListQuery.
+func ListsBefore(a, b *jobinator.Job) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID > b.ID
+}
+
+//DependencyStatus returns the status of a job that depends on jobs with the given statuses: Failed if one of them didn't finish successfully, Pending if all of them are done and Waiting otherwise.
+func DependencyStatus(statuses []int) int {
+	s := status.Pending
+	for _, x := range statuses {
+		switch x {
+		case status.Done:
+		case status.Failed, status.Timeout, status.Cancelled:
+			return status.Failed
+		default:
+			s = status.Waiting
+		}
+	}
+	return s
+}
+
+//HoldsUniqueKey returns whether the job still holds its unique key at the given time.
+func HoldsUniqueKey(j *jobinator.Job, now int64) bool {
+	if j.UniqueKey == nil {
+		return false
+	}
+	if j.UniqueUntil > now {
+		return true
+	}
+	return !status.Finished(j.Status)
+}
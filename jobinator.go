@@ -1,80 +1,343 @@
 package jobinator
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blasphemy/jobinator/status"
 	"github.com/gofrs/uuid"
 )
 
+//ErrTimeout is recorded as the job's error when it runs longer than its timeout.
+var ErrTimeout = errors.New("job timed out")
+
+//ErrNoResult is returned by ScanResult when the job's worker didn't set a result.
+var ErrNoResult = errors.New("job has no result")
+
+//PanicError is recorded as the job's error when its worker panics.
+type PanicError struct {
+	Value interface{}
+	Stack string //stack of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("worker panicked: %v", e.Value)
+}
+
+//errorStack returns the stack trace stored alongside a job error.
+func errorStack(err error) string {
+	if perr, ok := err.(*PanicError); ok {
+		return perr.Stack
+	}
+	if err == ErrTimeout {
+		return ""
+	}
+	return string(debug.Stack())
+}
+
+//runningJob is a job being executed by one of the client's background workers
+type runningJob struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
 //Client is the main handle for a jobinator instance. It is where you will perform most actions.
 type Client struct {
 	InternalClient
-	workers     []*BackgroundWorker
-	config      ClientConfig
-	workerFuncs map[string]WorkerFunc
+	workers          []*BackgroundWorker
+	workerLock       sync.Mutex
+	config           ClientConfig
+	workerFuncs      map[string]WorkerFunc
+	middleware       []Middleware
+	workerMiddleware map[string][]Middleware
+	running          map[string]*runningJob
+	abandoned        map[string]int       //jobs per worker name whose worker is still running after they timed out
+	slots            map[string]chan bool //per worker with a MaxConcurrency, holds a value for every job of the worker running in this process, abandoned ones included
+	runLock          sync.Mutex
+	backoffFuncs     map[string]BackoffFunc
+	backoffLock      sync.Mutex
+	lastReap         time.Time
+	reapLock         sync.Mutex
 }
 
 //NewClient will wrap a client implementation and return the resulting client. Meant to be used for implementing storage backends.
 func NewClient(ic InternalClient, config ClientConfig) *Client {
 	newc := &Client{
-		ic,
-		[]*BackgroundWorker{},
-		config,
-		make(map[string]WorkerFunc),
+		InternalClient:   ic,
+		workers:          []*BackgroundWorker{},
+		workerLock:       sync.Mutex{},
+		config:           config,
+		workerFuncs:      make(map[string]WorkerFunc),
+		workerMiddleware: make(map[string][]Middleware),
+		running:          make(map[string]*runningJob),
+		abandoned:        make(map[string]int),
+		slots:            make(map[string]chan bool),
+		runLock:          sync.Mutex{},
+		backoffFuncs:     make(map[string]BackoffFunc),
+		backoffLock:      sync.Mutex{},
+		reapLock:         sync.Mutex{},
+	}
+	if n, ok := ic.(Notifier); ok {
+		n.InternalSetNotifier(newc.wakeAllWorkers)
 	}
 	return newc
 }
 
 //RegisterWorker registers a new workerfunc against it's identifier(name)
 func (c *Client) RegisterWorker(name string, wf WorkerFunc) {
+	c.RegisterWorkerWithConfig(name, wf, WorkerConfig{})
+}
+
+//RegisterWorkerWithConfig is like RegisterWorker, with options like a concurrency limit.
+func (c *Client) RegisterWorkerWithConfig(name string, wf WorkerFunc, config WorkerConfig) {
 	c.workerFuncs[name] = wf
-	c.InternalRegisterWorker(name, wf)
+	c.workerMiddleware[name] = config.Middleware
+	if config.MaxConcurrency > 0 {
+		c.slots[name] = make(chan bool, config.MaxConcurrency)
+	} else {
+		delete(c.slots, name)
+	}
+	c.InternalRegisterWorker(name, wf, config)
 }
 
-func (c *Client) backgroundExecute() {
-	j, err := c.selectJob()
+//Use adds middleware that wraps every worker registered with the client. Middleware added first runs first, and all of it runs outside of the middleware given to RegisterWorkerWithConfig. Panics in middleware are recovered like panics in workers. Add middleware before starting background workers.
+func (c *Client) Use(middleware ...Middleware) {
+	c.middleware = append(c.middleware, middleware...)
+}
+
+//middlewareChain returns the client's middleware followed by the worker's middleware.
+func (c *Client) middlewareChain(name string) []Middleware {
+	return append(append([]Middleware{}, c.middleware...), c.workerMiddleware[name]...)
+}
+
+//wrapWorker wraps the worker in the middleware returned by middlewareChain.
+func wrapWorker(wf WorkerFunc, chain []Middleware) WorkerFunc {
+	for i := len(chain) - 1; i >= 0; i-- {
+		wf = chain[i](wf)
+	}
+	return wf
+}
+
+//backgroundExecute selects and runs a single job. It returns false if there was no job to run.
+func (c *Client) backgroundExecute(ctx context.Context, sc SelectConfig) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	j, err := c.selectJob(sc)
 	if err != nil || j == nil {
-		return
+		return false
+	}
+	release, ok := c.takeSlot(j.Name)
+	if !ok {
+		//another background worker of this process started a job of the worker after the backend counted them
+		c.requeue(j)
+		return false
+	}
+	c.executeJob(ctx, j, sc.WorkerID, release)
+	return true
+}
+
+//takeSlot takes one of the MaxConcurrency slots of the worker in this process. It returns false if all of them are taken, otherwise the returned func gives the slot back.
+func (c *Client) takeSlot(name string) (func(), bool) {
+	slot, ok := c.slots[name]
+	if !ok {
+		return func() {}, true
+	}
+	select {
+	case slot <- true:
+		return func() { <-slot }, true
+	default:
+		return nil, false
+	}
+}
+
+//requeue puts a job that didn't run back into the queue without using up a try.
+func (c *Client) requeue(j *Job) {
+	s := status.Pending
+	if j.RetryCount > 0 {
+		s = status.Retry
 	}
+	c.SetStatus(j, s)
+}
+
+//executeJob runs a selected job and stores its outcome. release is called once the job's worker returns.
+func (c *Client) executeJob(ctx context.Context, j *Job, workerID string, release func()) {
+	jctx, cancel := c.trackRunningJob(ctx, j)
+	defer c.untrackRunningJob(j, cancel)
 	ja := &JobRef{
-		j: j,
-		c: c,
+		j:   j,
+		c:   c,
+		ctx: jctx,
+	}
+	stopHeartbeat := c.heartbeat(j, workerID, cancel)
+	err := c.runWorker(jctx, j.Name, ja, release)
+	if stopHeartbeat() || c.runningJobCancelled(j.ID) {
+		return
+	}
+	if err != nil && err != ErrTimeout && ctx.Err() != nil {
+		//the background worker was stopped, so the job is put back into the queue without using up a try
+		c.requeue(j)
+		return
 	}
-	err = c.executeWorker(j.Name, ja)
 	c.SetFinishedAt(j, time.Now().Unix())
 	if err != nil {
 		errtxt := err.Error()
-		errstack := string(debug.Stack())
+		errstack := errorStack(err)
 		c.SetError(j, errtxt, errstack)
 		c.IncRetryCount(j)
 		if j.RetryCount > j.MaxRetry {
+			c.setBackoffFunc(j.ID, nil)
+			if err == ErrTimeout {
+				c.SetStatus(j, status.Timeout)
+				return
+			}
 			c.SetStatus(j, status.Failed)
 			return
 		}
+		delay := c.jobBackoff(j).duration(j.RetryCount, err)
+		if delay > 0 {
+			c.SetNextRun(j, time.Now().Add(delay).Unix())
+		}
 		c.SetStatus(j, status.Retry)
 		return
 	} else {
 		c.SetError(j, "", "")
 	}
 	if j.Repeat {
-		c.SetNextRun(j, time.Now().Add(j.RepeatInterval).Unix())
+		next, err := j.nextRun(time.Now())
+		if err != nil {
+			c.SetError(j, err.Error(), "")
+			c.SetStatus(j, status.Failed)
+			return
+		}
+		c.SetNextRun(j, next.Unix())
 		c.SetStatus(j, status.Pending)
 	} else {
+		c.setBackoffFunc(j.ID, nil)
 		c.SetStatus(j, status.Done)
 	}
 	return
 }
 
+//trackRunningJob derives the context a job runs with and registers it so the job can be cancelled while it is running.
+func (c *Client) trackRunningJob(ctx context.Context, j *Job) (context.Context, context.CancelFunc) {
+	var jctx context.Context
+	var cancel context.CancelFunc
+	timeout := j.Timeout
+	if timeout == 0 {
+		timeout = c.config.DefaultTimeout
+	}
+	if timeout > 0 {
+		jctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		jctx, cancel = context.WithCancel(ctx)
+	}
+	c.runLock.Lock()
+	c.running[j.ID] = &runningJob{
+		cancel: cancel,
+	}
+	c.runLock.Unlock()
+	return jctx, cancel
+}
+
+func (c *Client) untrackRunningJob(j *Job, cancel context.CancelFunc) {
+	c.runLock.Lock()
+	delete(c.running, j.ID)
+	c.runLock.Unlock()
+	cancel()
+}
+
+//cancelRunningJob cancels the context of a job running on this client. If the job itself was cancelled, it is flagged so its outcome isn't recorded.
+func (c *Client) cancelRunningJob(id string, jobCancelled bool) bool {
+	c.runLock.Lock()
+	rj, ok := c.running[id]
+	if ok && jobCancelled {
+		rj.cancelled = true
+	}
+	c.runLock.Unlock()
+	if ok {
+		rj.cancel()
+	}
+	return ok
+}
+
+//runningJobCancelled returns whether a job running on this client was cancelled through CancelJob.
+func (c *Client) runningJobCancelled(id string) bool {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	rj, ok := c.running[id]
+	return ok && rj.cancelled
+}
+
+//CancelRunningJob cancels the context of a job that is currently being executed by one of this client's background workers. The job is still treated like any other job whose worker returned an error. Use CancelJob to cancel the job itself. It returns false if the job is not running on this client.
+func (c *Client) CancelRunningJob(id string) bool {
+	return c.cancelRunningJob(id, false)
+}
+
+//Context returns the context of the job. It is cancelled when the background worker running the job is stopped, when the job's timeout expires or when the job is cancelled explicitly. Long running workers should watch it and return early.
+func (j *JobRef) Context() context.Context {
+	if j.ctx == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+//ID returns the ID of the job.
+func (j *JobRef) ID() string {
+	return j.j.ID
+}
+
+//Name returns the name of the worker the job is for.
+func (j *JobRef) Name() string {
+	return j.j.Name
+}
+
+//BatchID returns the ID of the batch the job belongs to, or is the callback of. It is empty for jobs that aren't part of a batch.
+func (j *JobRef) BatchID() string {
+	return j.j.BatchID
+}
+
 //ScanArgs scans the job's arguments into your struct of choice.
 func (j *JobRef) ScanArgs(v interface{}) error {
 	err := json.Unmarshal(j.j.Args, v)
 	return err
 }
 
+//SetResult stores the job's result. It is JSON encoded like the job's args, and can be read back with Job.ScanResult once the job has finished. Once the job has timed out, the result is discarded and ErrTimeout is returned.
+func (j *JobRef) SetResult(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.abandoned {
+		return ErrTimeout
+	}
+	return j.c.SetResult(j.j, b)
+}
+
+//abandon stops the job's worker from updating the job. It waits for updates that are in progress.
+func (j *JobRef) abandon() {
+	j.lock.Lock()
+	j.abandoned = true
+	j.lock.Unlock()
+}
+
+//ScanResult scans the result set by the job's worker into your struct of choice.
+func (j *Job) ScanResult(v interface{}) error {
+	if j.Result == nil {
+		return ErrNoResult
+	}
+	return json.Unmarshal(j.Result, v)
+}
+
 //StopAllWorkers stops all workers registered with the client. This is non blocking, so you may need to wait before they are all finished.
 func (c *Client) StopAllWorkers() {
 	for _, x := range c.workers {
@@ -103,49 +366,243 @@ func (c *Client) DestroyAllWorkers() {
 			x.StopBlocking()
 		}
 	}
+	c.workerLock.Lock()
 	c.workers = []*BackgroundWorker{}
+	c.workerLock.Unlock()
 }
 
-func (c *Client) executeWorker(name string, ref *JobRef) error {
-	_, ok := c.workerFuncs[name]
+//wakeAllWorkers wakes up idle background workers so they look for new jobs right away.
+func (c *Client) wakeAllWorkers() {
+	c.workerLock.Lock()
+	defer c.workerLock.Unlock()
+	for _, x := range c.workers {
+		x.wake()
+	}
+}
+
+//runWorker executes the worker in its own goroutine so a job that ignores its context can't block the background worker past its timeout. A job that is abandoned this way keeps running until its worker returns. Until then, its JobRef discards results and it still counts against its worker's MaxConcurrency in this process. release is called when the worker returns.
+func (c *Client) runWorker(ctx context.Context, name string, ref *JobRef, release func()) error {
+	//the worker is looked up here, since an abandoned goroutine isn't synchronized with anything once the background worker moves on
+	wf, ok := c.workerFuncs[name]
 	if !ok {
+		release()
 		return fmt.Errorf("Worker %s is not available", name)
 	}
-	err := c.workerFuncs[name](ref)
+	chain := c.middlewareChain(name)
+	done := make(chan error, 1)
+	go func() {
+		err := executeWorker(wf, chain, ref)
+		release()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			ref.abandon()
+			c.addAbandoned(name, 1)
+			go func() {
+				<-done
+				c.addAbandoned(name, -1)
+				c.wakeAllWorkers()
+			}()
+			return ErrTimeout
+		}
+		return <-done
+	}
+}
+
+func (c *Client) addAbandoned(name string, n int) {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	c.abandoned[name] += n
+	if c.abandoned[name] == 0 {
+		delete(c.abandoned, name)
+	}
+}
+
+//abandonedJobs returns a copy of the number of abandoned jobs per worker name, for SelectConfig.Abandoned.
+func (c *Client) abandonedJobs() map[string]int {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	abandoned := make(map[string]int, len(c.abandoned))
+	for k, v := range c.abandoned {
+		abandoned[k] = v
+	}
+	return abandoned
+}
+
+func executeWorker(wf WorkerFunc, chain []Middleware, ref *JobRef) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			//debug.Stack() still shows the frames that panicked while we are in the deferred call
+			err = &PanicError{
+				Value: r,
+				Stack: string(debug.Stack()),
+			}
+		}
+	}()
+	err = wrapWorker(wf, chain)(ref)
 	return err
 }
 
-func (c *Client) selectJob() (*Job, error) {
-	return c.InternalSelectJob()
+func (c *Client) selectJob(sc SelectConfig) (*Job, error) {
+	return c.InternalSelectJob(sc)
+}
+
+//EnqueueResult describes the job queued up by Enqueue
+type EnqueueResult struct {
+	ID      string
+	Created bool //false if an existing named job was updated
 }
 
 //EnqueueJob queues up a job to be run by a worker.
 func (c *Client) EnqueueJob(name string, args interface{}, config JobConfig) error {
+	_, err := c.Enqueue(name, args, config)
+	return err
+}
+
+//Enqueue is like EnqueueJob, and also returns the ID of the job. For a named job that was already enqueued, it returns the ID of the existing job, which is updated instead of creating a new one.
+func (c *Client) Enqueue(name string, args interface{}, config JobConfig) (EnqueueResult, error) {
+	j, created, err := c.enqueueJob(name, args, config)
+	if err != nil {
+		return EnqueueResult{}, err
+	}
+	return EnqueueResult{
+		ID:      j.ID,
+		Created: created,
+	}, nil
+}
+
+func (c *Client) enqueueJob(name string, args interface{}, config JobConfig) (*Job, bool, error) {
+	j, err := NewJob(name, args, config)
+	if err != nil {
+		return nil, false, err
+	}
+	created, err := c.InternalEnqueueJob(j)
+	if err != nil {
+		return nil, false, err
+	}
+	c.setBackoffFunc(j.ID, config.Backoff.Func)
+	c.wakeAllWorkers()
+	return j, created, nil
+}
+
+//JobSpec describes a job for EnqueueJobs, with the same arguments as EnqueueJob
+type JobSpec struct {
+	Name   string
+	Args   interface{}
+	Config JobConfig
+}
+
+//EnqueueJobs queues up all the jobs in a single round trip to the storage backend. Either all jobs are queued up or, if there is an error, none are. The results are in the same order as the specs.
+func (c *Client) EnqueueJobs(specs []JobSpec) ([]EnqueueResult, error) {
+	jobs := make([]*Job, len(specs))
+	for i, x := range specs {
+		j, err := NewJob(x.Name, x.Args, x.Config)
+		if err != nil {
+			return nil, err
+		}
+		jobs[i] = j
+	}
+	created, err := c.InternalEnqueueJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]EnqueueResult, len(jobs))
+	for i, x := range jobs {
+		c.setBackoffFunc(x.ID, specs[i].Config.Backoff.Func)
+		results[i] = EnqueueResult{
+			ID:      x.ID,
+			Created: created[i],
+		}
+	}
+	c.wakeAllWorkers()
+	return results, nil
+}
+
+//NewJob builds the job that EnqueueJob queues up, for code that queues up jobs without going through a Client, like gormclient's EnqueueJobTx.
+func NewJob(name string, args interface{}, config JobConfig) (*Job, error) {
 	ctx, err := json.Marshal(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	id, err := uuid.NewV4()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	j := &Job{
-		ID:             id.String(),
-		Name:           name,
-		Args:           ctx,
-		Status:         status.Pending,
-		MaxRetry:       config.MaxRetry,
-		Repeat:         config.Repeat,
-		RepeatInterval: config.RepeatInterval,
-		NamedJob:       config.Identifier,
+		ID:              id.String(),
+		Name:            name,
+		Args:            ctx,
+		CreatedAt:       time.Now().Unix(),
+		EnqueuedAt:      nextEnqueuedAt(),
+		Status:          status.Pending,
+		MaxRetry:        config.MaxRetry,
+		Repeat:          config.Repeat,
+		RepeatInterval:  config.RepeatInterval,
+		NamedJob:        config.Identifier,
+		Timeout:         config.Timeout,
+		BackoffStrategy: config.Backoff.Strategy,
+		BackoffDelay:    config.Backoff.Delay,
+		BackoffMaxDelay: config.Backoff.MaxDelay,
+		BackoffJitter:   config.Backoff.Jitter,
+		Cron:            config.Cron,
+		Queue:           config.Queue,
+		Priority:        config.Priority,
+		DependsOn:       config.DependsOn,
 	}
-	if config.Repeat {
-		j.NextRun = time.Now().Add(j.RepeatInterval).Unix()
+	if len(j.DependsOn) > 0 {
+		j.Status = status.Waiting
+	}
+	if config.Unique != nil {
+		key := uniqueKey(name, j.Args, config.Unique)
+		j.UniqueKey = &key
+		if config.Unique.Window > 0 {
+			j.UniqueUntil = time.Now().Add(config.Unique.Window).Unix()
+		}
+	}
+	if j.Queue == "" {
+		j.Queue = DefaultQueue
+	}
+	if config.Cron != "" {
+		j.Repeat = true
+	}
+	if j.Repeat {
+		next, err := j.nextRun(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		j.NextRun = next.Unix()
+	}
+	if !config.RunAt.IsZero() {
+		j.NextRun = config.RunAt.Unix()
+	} else if config.RunIn > 0 {
+		j.NextRun = time.Now().Add(config.RunIn).Unix()
+	}
+	return j, nil
+}
+
+//lastEnqueuedAt is the EnqueuedAt of the job created last by NewJob
+var lastEnqueuedAt int64
+
+//nextEnqueuedAt returns the current time in unix nanoseconds, but always later than the last time it returned, so jobs created back to back are ordered even if the clock doesn't advance between them.
+func nextEnqueuedAt() int64 {
+	for {
+		last := atomic.LoadInt64(&lastEnqueuedAt)
+		now := time.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastEnqueuedAt, last, now) {
+			return now
+		}
 	}
-	return c.InternalEnqueueJob(j)
 }
 
-//PendingJobs returns the number of pending jobs.
+//PendingJobs returns the jobs that are waiting to run and due. Jobs scheduled for later are not included.
 func (c *Client) PendingJobs() ([]*Job, error) {
 	return c.InternalPendingJobs()
 }
@@ -169,7 +626,9 @@ func (c *Client) NamedJobInfo(name string) (JobInfo, error) {
 		NextRun:        nr,
 		RepeatInterval: j.RepeatInterval,
 		Repeat:         j.Repeat,
+		Cron:           j.Cron,
 		Args:           j.Args,
+		Result:         j.Result,
 	}
 	return jinfo, nil
 }
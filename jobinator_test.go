@@ -1,11 +1,15 @@
 package jobinator
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/blasphemy/jobinator/status"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -155,3 +159,606 @@ func TestCleanup(t *testing.T) {
 		MaxAge: time.Second,
 	})
 }
+
+func TestJobContextCancelledOnStop(t *testing.T) {
+	td["ctx"] = 0
+	wf := func(j *JobRef) error {
+		select {
+		case <-j.Context().Done():
+			tdLock.Lock()
+			td["ctx"]++
+			tdLock.Unlock()
+			return j.Context().Err()
+		case <-time.After(time.Second * 10):
+			return nil
+		}
+	}
+	c.RegisterWorker("ctx", wf)
+	res, err := c.Enqueue("ctx", nil, JobConfig{})
+	assert.Nil(t, err)
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second)
+	start := time.Now()
+	c.StopAllWorkersBlocking()
+	assert.True(t, time.Since(start) < time.Second*5)
+	c.DestroyAllWorkers()
+	tdLock.Lock()
+	assert.Equal(t, 1, td["ctx"])
+	tdLock.Unlock()
+	//the job was interrupted, not failed, so it is back in the queue with all of its tries
+	j, err := c.GetJob(res.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+	assert.Equal(t, 0, j.RetryCount)
+	assert.Equal(t, "", j.Error)
+	//don't leave it for the background workers of the next tests
+	assert.Nil(t, c.CancelJob(res.ID))
+}
+
+func TestStopIdleWorker(t *testing.T) {
+	sc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second * 5,
+	})
+	var started int32
+	sc.RegisterWorker("idle", func(j *JobRef) error {
+		atomic.AddInt32(&started, 1)
+		select {
+		case <-j.Context().Done():
+		case <-time.After(time.Second * 3):
+		}
+		return nil
+	})
+	bw := sc.NewBackgroundWorker()
+	bw.Start()
+	time.Sleep(time.Second / 10)
+	//queued up without waking the worker, so it is still idle when it is stopped
+	j, err := NewJob("idle", nil, JobConfig{})
+	assert.Nil(t, err)
+	_, err = sc.InternalEnqueueJob(j)
+	assert.Nil(t, err)
+	start := time.Now()
+	bw.Stop()
+	for bw.IsRunning() {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&started))
+	j, err = sc.GetJob(j.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+	//stopping it again is harmless
+	bw.Stop()
+}
+
+func TestJobContextTimeout(t *testing.T) {
+	td["ctx_timeout"] = 0
+	wf := func(j *JobRef) error {
+		<-j.Context().Done()
+		tdLock.Lock()
+		td["ctx_timeout"]++
+		tdLock.Unlock()
+		return j.Context().Err()
+	}
+	c.RegisterWorker("ctx_timeout", wf)
+	c.EnqueueJob("ctx_timeout", nil, JobConfig{
+		Timeout: time.Second / 2,
+	})
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 2)
+	c.DestroyAllWorkers()
+	tdLock.Lock()
+	assert.Equal(t, 1, td["ctx_timeout"])
+	tdLock.Unlock()
+}
+
+func TestJobTimeout(t *testing.T) {
+	wf := func(j *JobRef) error {
+		time.Sleep(time.Second * 5)
+		return nil
+	}
+	c.RegisterWorker("hung", wf)
+	c.EnqueueJob("hung", nil, JobConfig{
+		Identifier: "hung_job",
+		Timeout:    time.Second / 2,
+	})
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 2)
+	c.DestroyAllWorkers()
+	j, err := c.GetNamedJob("hung_job")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Timeout, j.Status)
+	assert.Equal(t, ErrTimeout.Error(), j.Error)
+	assert.Equal(t, 1, j.RetryCount)
+}
+
+func panickingWorker(j *JobRef) error {
+	var m map[string]int
+	m["boom"]++
+	return nil
+}
+
+func TestWorkerPanic(t *testing.T) {
+	c.RegisterWorker("panic", panickingWorker)
+	c.EnqueueJob("panic", nil, JobConfig{
+		Identifier: "panic_job",
+		MaxRetry:   1,
+	})
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 2)
+	c.DestroyAllWorkers()
+	j, err := c.GetNamedJob("panic_job")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	assert.Equal(t, 2, j.RetryCount)
+	assert.Contains(t, j.Error, "worker panicked")
+	assert.Contains(t, j.ErrorStack, "panickingWorker")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	td["backoff"] = 0
+	wf := func(j *JobRef) error {
+		tdLock.Lock()
+		defer tdLock.Unlock()
+		td["backoff"]++
+		return errors.New("should error")
+	}
+	c.RegisterWorker("backoff", wf)
+	c.EnqueueJob("backoff", nil, JobConfig{
+		MaxRetry: 1,
+		Backoff: Backoff{
+			Strategy: BackoffConstant,
+			Delay:    time.Second * 3,
+		},
+	})
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 2)
+	tdLock.Lock()
+	assert.Equal(t, 1, td["backoff"])
+	tdLock.Unlock()
+	time.Sleep(time.Second * 3)
+	c.DestroyAllWorkers()
+	tdLock.Lock()
+	assert.Equal(t, 2, td["backoff"])
+	tdLock.Unlock()
+}
+
+func TestBackoffDuration(t *testing.T) {
+	for _, x := range []struct {
+		name       string
+		backoff    Backoff
+		retryCount int
+		expected   time.Duration
+	}{
+		{"none", Backoff{Delay: time.Second}, 3, 0},
+		{"constant", Backoff{Strategy: BackoffConstant, Delay: time.Second}, 1, time.Second},
+		{"constant later retry", Backoff{Strategy: BackoffConstant, Delay: time.Second}, 5, time.Second},
+		{"constant capped", Backoff{Strategy: BackoffConstant, Delay: time.Second * 5, MaxDelay: time.Second * 2}, 1, time.Second * 2},
+		{"linear first retry", Backoff{Strategy: BackoffLinear, Delay: time.Second}, 1, time.Second},
+		{"linear", Backoff{Strategy: BackoffLinear, Delay: time.Second}, 3, time.Second * 3},
+		{"linear capped", Backoff{Strategy: BackoffLinear, Delay: time.Second, MaxDelay: time.Second * 2}, 3, time.Second * 2},
+		{"exponential first retry", Backoff{Strategy: BackoffExponential, Delay: time.Second}, 1, time.Second},
+		{"exponential second retry", Backoff{Strategy: BackoffExponential, Delay: time.Second}, 2, time.Second * 2},
+		{"exponential", Backoff{Strategy: BackoffExponential, Delay: time.Second}, 4, time.Second * 8},
+		{"exponential below cap", Backoff{Strategy: BackoffExponential, Delay: time.Second, MaxDelay: time.Second * 10}, 4, time.Second * 8},
+		{"exponential capped", Backoff{Strategy: BackoffExponential, Delay: time.Second, MaxDelay: time.Second * 10}, 5, time.Second * 10},
+		{"exponential capped far out", Backoff{Strategy: BackoffExponential, Delay: time.Second, MaxDelay: time.Second * 10}, 100, time.Second * 10},
+	} {
+		assert.Equal(t, x.expected, x.backoff.duration(x.retryCount, nil), x.name)
+	}
+	//doubling stops before the delay overflows
+	b := Backoff{
+		Strategy: BackoffExponential,
+		Delay:    time.Second,
+	}
+	assert.True(t, b.duration(1000, nil) > 0)
+	//jitter picks a delay between half and all of the delay
+	for _, x := range []struct {
+		backoff    Backoff
+		retryCount int
+	}{
+		{Backoff{Strategy: BackoffConstant, Delay: time.Second * 4, Jitter: true}, 3},
+		{Backoff{Strategy: BackoffLinear, Delay: time.Second * 2, Jitter: true}, 2},
+		{Backoff{Strategy: BackoffExponential, Delay: time.Second, Jitter: true}, 3},
+		{Backoff{Strategy: BackoffExponential, Delay: time.Second, MaxDelay: time.Second * 4, Jitter: true}, 10},
+	} {
+		full := time.Second * 4
+		for i := 0; i < 100; i++ {
+			d := x.backoff.duration(x.retryCount, nil)
+			assert.True(t, d >= full/2 && d < full, "%v not in [%v, %v)", d, full/2, full)
+		}
+	}
+	b = Backoff{
+		Strategy: BackoffExponential,
+		Delay:    time.Second,
+		Func: func(retryCount int, err error) time.Duration {
+			return time.Duration(retryCount) * time.Minute
+		},
+	}
+	assert.Equal(t, time.Minute*2, b.duration(2, nil))
+}
+
+func TestScheduledJob(t *testing.T) {
+	td["scheduled"] = 0
+	wf := func(j *JobRef) error {
+		tdLock.Lock()
+		td["scheduled"]++
+		tdLock.Unlock()
+		return nil
+	}
+	c.RegisterWorker("scheduled", wf)
+	c.EnqueueJob("scheduled", nil, JobConfig{
+		RunIn: time.Second * 3,
+	})
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 2)
+	tdLock.Lock()
+	assert.Equal(t, 0, td["scheduled"])
+	tdLock.Unlock()
+	time.Sleep(time.Second * 3)
+	c.DestroyAllWorkers()
+	tdLock.Lock()
+	assert.Equal(t, 1, td["scheduled"])
+	tdLock.Unlock()
+}
+
+func TestCronJob(t *testing.T) {
+	td["cron"] = 0
+	wf := func(j *JobRef) error {
+		tdLock.Lock()
+		td["cron"]++
+		tdLock.Unlock()
+		return nil
+	}
+	c.RegisterWorker("cron", wf)
+	err := c.EnqueueJob("cron", nil, JobConfig{
+		Cron: "not a cron spec",
+	})
+	assert.NotNil(t, err)
+	err = c.EnqueueJob("cron", nil, JobConfig{
+		Identifier: "cron_job",
+		Cron:       "*/2 * * * * *",
+	})
+	assert.Nil(t, err)
+	info, err := c.NamedJobInfo("cron_job")
+	assert.Nil(t, err)
+	assert.True(t, info.Repeat)
+	runs := info.NextRuns(3)
+	assert.Equal(t, 3, len(runs))
+	assert.Equal(t, time.Second*2, runs[2].Sub(runs[1]))
+	assert.Zero(t, runs[0].Second()%2)
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 5)
+	c.DestroyAllWorkers()
+	tdLock.Lock()
+	assert.True(t, td["cron"] >= 2)
+	tdLock.Unlock()
+}
+
+func TestWorkerDrainsBacklog(t *testing.T) {
+	wc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second * 2,
+	})
+	var count int32
+	wc.RegisterWorker("drain", func(j *JobRef) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	for i := 0; i < 10; i++ {
+		wc.EnqueueJob("drain", nil, JobConfig{})
+	}
+	wc.NewBackgroundWorker()
+	wc.StartAllWorkers()
+	time.Sleep(time.Second)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&count))
+	wc.DestroyAllWorkers()
+}
+
+func TestWorkerWakeup(t *testing.T) {
+	wc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second * 4,
+	})
+	var count int32
+	wc.RegisterWorker("wake", func(j *JobRef) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	wc.NewBackgroundWorker()
+	wc.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	wc.EnqueueJob("wake", nil, JobConfig{})
+	time.Sleep(time.Second / 2)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	//jobs the backend learns about on its own only get picked up early if it notifies the client
+	m := wc.InternalClient.(*MockClient)
+	m.InternalEnqueueJob(&Job{
+		ID:     "notified",
+		Name:   "wake",
+		Status: status.Pending,
+	})
+	time.Sleep(time.Second / 2)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	m.notify()
+	time.Sleep(time.Second / 2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+	wc.DestroyAllWorkers()
+}
+
+func TestReapExpiredJobs(t *testing.T) {
+	m := c.InternalClient.(*MockClient)
+	for i, maxRetry := range []int{1, 0} {
+		m.InternalEnqueueJob(&Job{
+			ID:             fmt.Sprintf("crashed_%d", i),
+			Name:           "crashed",
+			NamedJob:       fmt.Sprintf("crashed_%d", i),
+			Status:         status.Running,
+			MaxRetry:       maxRetry,
+			LockedBy:       "dead worker",
+			LeaseExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		})
+	}
+	reaped, err := c.ReapExpiredJobs()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reaped)
+	j, err := c.GetNamedJob("crashed_0")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Retry, j.Status)
+	assert.Equal(t, 1, j.RetryCount)
+	assert.Equal(t, ErrLeaseExpired.Error(), j.Error)
+	assert.Equal(t, int64(0), j.FinishedAt)
+	j, err = c.GetNamedJob("crashed_1")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	assert.True(t, j.FinishedAt >= time.Now().Add(-time.Minute).Unix())
+}
+
+func TestHeartbeatKeepsLease(t *testing.T) {
+	hc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+		LeaseDuration:   time.Second,
+	})
+	var count int32
+	hc.RegisterWorker("slow", func(j *JobRef) error {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(time.Second * 3)
+		return nil
+	})
+	hc.EnqueueJob("slow", nil, JobConfig{
+		Identifier: "slow_job",
+	})
+	hc.NewBackgroundWorker()
+	hc.NewBackgroundWorker()
+	hc.StartAllWorkers()
+	time.Sleep(time.Second * 4)
+	hc.DestroyAllWorkers()
+	j, err := hc.GetNamedJob("slow_job")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Done, j.Status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+}
+
+func TestLostLeaseNotOverwritten(t *testing.T) {
+	lc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	m := lc.InternalClient.(*MockClient)
+	lc.RegisterWorker("lost", func(j *JobRef) error {
+		//the job is reaped and handed to another worker before this one returns
+		m.joblock.Lock()
+		j.j.LockedBy = "other worker"
+		m.joblock.Unlock()
+		return errors.New("too late")
+	})
+	res, err := lc.Enqueue("lost", nil, JobConfig{})
+	assert.Nil(t, err)
+	lc.NewBackgroundWorker()
+	lc.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	lc.DestroyAllWorkers()
+	j, err := lc.GetJob(res.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Running, j.Status)
+	assert.Equal(t, "other worker", j.LockedBy)
+	assert.Equal(t, 0, j.RetryCount)
+	assert.Equal(t, "", j.Error)
+}
+
+func TestCancelJob(t *testing.T) {
+	cc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	var count int32
+	started := make(chan bool, 1)
+	cc.RegisterWorker("cancel", func(j *JobRef) error {
+		atomic.AddInt32(&count, 1)
+		started <- true
+		<-j.Context().Done()
+		return j.Context().Err()
+	})
+	cc.EnqueueJob("cancel", nil, JobConfig{
+		Identifier: "scheduled",
+		RunIn:      time.Hour,
+	})
+	err := cc.CancelNamedJob("scheduled")
+	assert.Nil(t, err)
+	cc.EnqueueJob("cancel", nil, JobConfig{
+		Identifier: "running",
+		MaxRetry:   5,
+	})
+	cc.NewBackgroundWorker()
+	cc.StartAllWorkers()
+	<-started
+	err = cc.CancelNamedJob("running")
+	assert.Nil(t, err)
+	time.Sleep(time.Second / 2)
+	cc.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	for _, x := range []string{"scheduled", "running"} {
+		j, err := cc.GetNamedJob(x)
+		assert.Nil(t, err)
+		assert.Equal(t, status.Cancelled, j.Status)
+		assert.Equal(t, 0, j.RetryCount)
+	}
+	err = cc.CancelNamedJob("running")
+	assert.Equal(t, ErrJobFinished, err)
+	err = cc.CancelJob("missing")
+	assert.Equal(t, ErrJobNotFound, err)
+}
+
+func TestNoResult(t *testing.T) {
+	j := &Job{}
+	v := 0
+	assert.Equal(t, ErrNoResult, j.ScanResult(&v))
+}
+
+func TestEnqueueReturnsID(t *testing.T) {
+	ec := newMockClient(ClientConfig{})
+	res, err := ec.Enqueue("id", nil, JobConfig{})
+	assert.Nil(t, err)
+	assert.True(t, res.Created)
+	j, err := ec.GetJob(res.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "id", j.Name)
+	named, err := ec.Enqueue("id", nil, JobConfig{
+		Identifier: "named_id",
+	})
+	assert.Nil(t, err)
+	assert.True(t, named.Created)
+	again, err := ec.Enqueue("id", 1, JobConfig{
+		Identifier: "named_id",
+	})
+	assert.Nil(t, err)
+	assert.False(t, again.Created)
+	assert.Equal(t, named.ID, again.ID)
+}
+
+func TestMiddleware(t *testing.T) {
+	mc := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	calls := []string{}
+	callLock := sync.Mutex{}
+	record := func(name string) Middleware {
+		return func(next WorkerFunc) WorkerFunc {
+			return func(j *JobRef) error {
+				callLock.Lock()
+				calls = append(calls, name+" "+j.Name())
+				callLock.Unlock()
+				return next(j)
+			}
+		}
+	}
+	mc.Use(record("first"), record("second"))
+	mc.RegisterWorkerWithConfig("wrapped", func(j *JobRef) error {
+		callLock.Lock()
+		calls = append(calls, "worker")
+		callLock.Unlock()
+		return nil
+	}, WorkerConfig{
+		Middleware: []Middleware{record("own")},
+	})
+	mc.RegisterWorkerWithConfig("panicking", func(j *JobRef) error {
+		return nil
+	}, WorkerConfig{
+		Middleware: []Middleware{func(next WorkerFunc) WorkerFunc {
+			return func(j *JobRef) error {
+				panic("middleware")
+			}
+		}},
+	})
+	mc.EnqueueJob("wrapped", nil, JobConfig{})
+	mc.EnqueueJob("panicking", nil, JobConfig{
+		Identifier: "panicking",
+	})
+	mc.NewBackgroundWorker()
+	mc.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	mc.DestroyAllWorkers()
+	callLock.Lock()
+	assert.Equal(t, []string{"first wrapped", "second wrapped", "own wrapped", "worker", "first panicking", "second panicking"}, calls)
+	callLock.Unlock()
+	j, err := mc.GetNamedJob("panicking")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	assert.Equal(t, "worker panicked: middleware", j.Error)
+}
+
+func TestAbandonedJobKeepsConcurrencySlot(t *testing.T) {
+	ac := newMockClient(ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	var running, maxRunning int32
+	resultErrs := make(chan error, 10)
+	ac.RegisterWorkerWithConfig("ignores_timeout", func(j *JobRef) error {
+		n := atomic.AddInt32(&running, 1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		time.Sleep(time.Second)
+		resultErrs <- j.SetResult("late")
+		atomic.AddInt32(&running, -1)
+		return nil
+	}, WorkerConfig{
+		MaxConcurrency: 1,
+	})
+	//both tries time out, and the second one returns well before the workers are stopped
+	res, err := ac.Enqueue("ignores_timeout", nil, JobConfig{
+		MaxRetry: 1,
+		Timeout:  time.Second / 5,
+	})
+	assert.Nil(t, err)
+	ac.NewBackgroundWorker()
+	ac.NewBackgroundWorker()
+	ac.StartAllWorkers()
+	time.Sleep(time.Second * 3)
+	ac.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+	//every run timed out, so none of them may store its result
+	assert.Equal(t, 2, len(resultErrs))
+	assert.Equal(t, ErrTimeout, <-resultErrs)
+	assert.Equal(t, ErrTimeout, <-resultErrs)
+	j, err := ac.GetJob(res.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Timeout, j.Status)
+	assert.Equal(t, ErrNoResult, j.ScanResult(new(string)))
+}
+
+func TestConcurrencySlotTakenInProcess(t *testing.T) {
+	lc := newMockClient(ClientConfig{})
+	var runs int32
+	lc.RegisterWorkerWithConfig("slotted", func(j *JobRef) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}, WorkerConfig{
+		MaxConcurrency: 1,
+	})
+	res, err := lc.Enqueue("slotted", nil, JobConfig{})
+	assert.Nil(t, err)
+	//the slot is taken by a job that another background worker has selected, but the backend didn't count yet
+	release, ok := lc.takeSlot("slotted")
+	assert.True(t, ok)
+	sc := SelectConfig{
+		WorkerID: "slotted_worker",
+	}
+	assert.False(t, lc.backgroundExecute(context.Background(), sc))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runs))
+	j, err := lc.GetJob(res.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+	assert.Equal(t, 0, j.RetryCount)
+	release()
+	assert.True(t, lc.backgroundExecute(context.Background(), sc))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	j, err = lc.GetJob(res.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Done, j.Status)
+	//the slot was given back once the worker returned
+	_, ok = lc.takeSlot("slotted")
+	assert.True(t, ok)
+}
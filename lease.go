@@ -0,0 +1,74 @@
+package jobinator
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//DefaultLeaseDuration is used when ClientConfig.LeaseDuration is not set.
+const DefaultLeaseDuration = time.Minute
+
+//ErrLeaseLost is returned by RenewLease when the job is no longer running under the worker trying to renew it, e.g. because its lease expired and it was handed to another worker.
+var ErrLeaseLost = errors.New("job lease lost")
+
+//ErrLeaseExpired is recorded as the job's error when it is requeued because its lease expired.
+var ErrLeaseExpired = errors.New("job lease expired")
+
+func (c *Client) leaseDuration() time.Duration {
+	if c.config.LeaseDuration > 0 {
+		return c.config.LeaseDuration
+	}
+	return DefaultLeaseDuration
+}
+
+//heartbeat renews the lease of a running job until the returned function is called. If the lease is lost, the job's context is cancelled. The returned function waits for the heartbeat to stop and then renews the lease one last time, so the job can't be reaped while its outcome is recorded. It reports whether the lease was lost, in which case the job belongs to someone else and must not be updated anymore.
+func (c *Client) heartbeat(j *Job, workerID string, cancel context.CancelFunc) func() bool {
+	lease := c.leaseDuration()
+	done := make(chan bool)
+	exited := make(chan bool)
+	lost := false
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := c.RenewLease(j, workerID, time.Now().Add(lease).Unix())
+				if err == ErrLeaseLost {
+					lost = true
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-exited
+		if lost {
+			return true
+		}
+		return c.RenewLease(j, workerID, time.Now().Add(lease).Unix()) == ErrLeaseLost
+	}
+}
+
+//ReapExpiredJobs requeues running jobs whose lease has expired, which happens when the process running them died. A requeued job counts as a failed try, so it is marked as failed if it has no retries left. It returns the number of jobs that were reaped. Background workers call this on their own while they are idle.
+func (c *Client) ReapExpiredJobs() (int, error) {
+	return c.InternalReapExpiredJobs()
+}
+
+//reapExpiredJobsIfDue runs ReapExpiredJobs at most once per half lease duration, no matter how many background workers call it.
+func (c *Client) reapExpiredJobsIfDue() {
+	c.reapLock.Lock()
+	if time.Since(c.lastReap) < c.leaseDuration()/2 {
+		c.reapLock.Unlock()
+		return
+	}
+	c.lastReap = time.Now()
+	c.reapLock.Unlock()
+	c.ReapExpiredJobs()
+}
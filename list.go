@@ -0,0 +1,64 @@
+package jobinator
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//ErrInvalidCursor is returned by ListJobs when the cursor wasn't returned by an earlier call.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+//GetJob returns the job with the given ID, or ErrJobNotFound.
+func (c *Client) GetJob(id string) (*Job, error) {
+	return c.InternalGetJob(id)
+}
+
+//ListJobs returns the jobs matching the filter in the ListConfig, newest first. If there may be more jobs, it also returns a cursor to pass in the next ListConfig to get them.
+func (c *Client) ListJobs(config ListConfig) ([]*Job, string, error) {
+	q := ListQuery{
+		Filter: config.Filter,
+		Limit:  config.Limit,
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultListLimit
+	}
+	if config.Cursor != "" {
+		var err error
+		q.AfterCreatedAt, q.AfterID, err = decodeCursor(config.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	jobs, err := c.InternalListJobs(q)
+	if err != nil {
+		return nil, "", err
+	}
+	cursor := ""
+	if len(jobs) == q.Limit {
+		cursor = encodeCursor(jobs[len(jobs)-1])
+	}
+	return jobs, cursor, nil
+}
+
+func encodeCursor(j *Job) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", j.CreatedAt, j.ID)))
+}
+
+func decodeCursor(cursor string) (int64, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", ErrInvalidCursor
+	}
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return createdAt, parts[1], nil
+}
@@ -0,0 +1,62 @@
+package memoryclient
+
+import (
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
+	"github.com/blasphemy/jobinator/status"
+)
+
+//InternalEnqueueBatch queues up the batch, its jobs and its callback job while holding the lock once. The callback job is queued up first, since jobs that fail because of a job they depend on finish right away and may finish the batch.
+func (m *MemoryClient) InternalEnqueueBatch(b *jobinator.Batch, jobs []*jobinator.Job, callback *jobinator.Job) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	err := m.checkJobs(jobs)
+	if err != nil {
+		return err
+	}
+	nb := *b
+	m.batches[b.ID] = &nb
+	if callback != nil {
+		m.enqueueJob(callback)
+	}
+	for _, x := range jobs {
+		m.enqueueJob(x)
+	}
+	return nil
+}
+
+//InternalGetBatch returns a copy of the batch with the given ID.
+func (m *MemoryClient) InternalGetBatch(id string) (*jobinator.Batch, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	b, ok := m.batches[id]
+	if !ok {
+		return nil, jobinator.ErrBatchNotFound
+	}
+	nb := *b
+	return &nb, nil
+}
+
+//batchJobRetried takes back the count of a finished job of a batch that is retried. Callers must hold joblock.
+func (m *MemoryClient) batchJobRetried(j *jobinator.Job) {
+	b, ok := m.batches[j.BatchID]
+	if !ok || b.CallbackJobID == j.ID {
+		return
+	}
+	backend.BatchJobRetried(b, j.Status)
+}
+
+//batchJobFinished counts a finished job of a batch, and queues up the batch's callback job if it was the last one. Callers must hold joblock.
+func (m *MemoryClient) batchJobFinished(j *jobinator.Job) {
+	b, ok := m.batches[j.BatchID]
+	if !ok || b.CallbackJobID == j.ID || !backend.BatchJobFinished(b, j.Status) {
+		return
+	}
+	for _, x := range m.jobs {
+		if x.ID == b.CallbackJobID && x.Status == status.Waiting {
+			m.update(x, func() {
+				x.Status = status.Pending
+			})
+		}
+	}
+}
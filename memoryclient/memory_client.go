@@ -1,53 +1,142 @@
 package memoryclient
 
 import (
-	"errors"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
 	"github.com/blasphemy/jobinator/status"
 )
 
 //MemoryClient is the internal client of a memory backed jobinator instance
 type MemoryClient struct {
-	jobs    []*jobinator.Job
-	joblock sync.Mutex
-	wfList  []string
+	jobs     []*jobinator.Job
+	joblock  sync.Mutex
+	wfList   []string
+	limits   map[string]int //MaxConcurrency per worker name
+	buckets  map[string]*bucket
+	stats    *stats
+	watchers map[string][]chan struct{}
+	batches  map[string]*jobinator.Batch
 }
 
 //NewMemoryClient returns a new jobinator client that stores all jobs in memory
 func NewMemoryClient(config jobinator.ClientConfig) *jobinator.Client {
 	newmc := &MemoryClient{
-		jobs:    []*jobinator.Job{},
-		joblock: sync.Mutex{},
-		wfList:  []string{},
+		jobs:     []*jobinator.Job{},
+		joblock:  sync.Mutex{},
+		wfList:   []string{},
+		limits:   make(map[string]int),
+		buckets:  make(map[string]*bucket),
+		stats:    newStats(),
+		watchers: make(map[string][]chan struct{}),
+		batches:  make(map[string]*jobinator.Batch),
 	}
 	newc := jobinator.NewClient(newmc, config)
 	return newc
 }
 
-//InternalEnqueueJob queues up a job on the in memory store
-func (m *MemoryClient) InternalEnqueueJob(j *jobinator.Job) error {
+//InternalEnqueueJob queues up a job on the in memory store. It returns false if an existing named job was updated instead.
+func (m *MemoryClient) InternalEnqueueJob(j *jobinator.Job) (bool, error) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
+	return m.enqueueJob(j)
+}
+
+//InternalEnqueueJobs queues up all the jobs while holding the lock once.
+func (m *MemoryClient) InternalEnqueueJobs(jobs []*jobinator.Job) ([]bool, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	//nothing may be queued up if one of the jobs can't be
+	err := m.checkJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+	created := make([]bool, len(jobs))
+	for i, x := range jobs {
+		created[i], _ = m.enqueueJob(x)
+	}
+	return created, nil
+}
+
+//enqueueJob returns false if an existing named job was updated. Callers must hold joblock.
+func (m *MemoryClient) enqueueJob(j *jobinator.Job) (bool, error) {
 	if j.NamedJob != "" {
 		for _, x := range m.jobs {
 			if x.NamedJob == j.NamedJob {
-				x.Args = j.Args
-				x.MaxRetry = j.MaxRetry
-				x.Repeat = j.Repeat
-				x.RepeatInterval = j.RepeatInterval
-				x.Name = j.Name
-				if j.Repeat {
-					x.NextRun = x.FinishedAt + int64(j.RepeatInterval.Seconds())
-				}
-				return nil
+				m.update(x, func() {
+					x.Args = j.Args
+					x.MaxRetry = j.MaxRetry
+					x.Repeat = j.Repeat
+					x.RepeatInterval = j.RepeatInterval
+					x.Name = j.Name
+					x.Timeout = j.Timeout
+					x.BackoffStrategy = j.BackoffStrategy
+					x.BackoffDelay = j.BackoffDelay
+					x.BackoffMaxDelay = j.BackoffMaxDelay
+					x.BackoffJitter = j.BackoffJitter
+					x.Cron = j.Cron
+					x.Queue = j.Queue
+					x.Priority = j.Priority
+					if j.Repeat && j.Cron == "" {
+						x.NextRun = x.FinishedAt + int64(j.RepeatInterval.Seconds())
+					} else {
+						x.NextRun = j.NextRun
+					}
+				})
+				j.ID = x.ID
+				return false, nil
 			}
 		}
 	}
+	if len(j.DependsOn) > 0 {
+		s, err := m.dependencyStatus(j, true)
+		if err != nil {
+			return false, err
+		}
+		setDependencyStatus(j, s)
+	}
+	if j.UniqueKey != nil && m.uniqueKeyHeld(*j.UniqueKey) {
+		return false, jobinator.ErrDuplicateJob
+	}
 	m.jobs = append(m.jobs, j)
-	return nil
+	m.stats.add(j, 1)
+	if status.Finished(j.Status) {
+		//the job failed because of a job it depends on
+		m.batchJobFinished(j)
+	}
+	return true, nil
+}
+
+//isReady returns whether a job is waiting to run and due.
+func isReady(j *jobinator.Job) bool {
+	if j.Status != status.Pending && j.Status != status.Retry {
+		return false
+	}
+	return time.Now().Unix() >= j.NextRun
+}
+
+//runsBefore returns whether a should be selected before b. Jobs that compare equal keep their order in m.jobs.
+func runsBefore(a, b *jobinator.Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.EnqueuedAt < b.EnqueuedAt
+}
+
+//inQueues returns whether a job is in one of the queues, an empty list matching every queue.
+func inQueues(j *jobinator.Job, queues []string) bool {
+	if len(queues) == 0 {
+		return true
+	}
+	for _, x := range queues {
+		if j.Queue == x {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *MemoryClient) listContains(name string) bool {
@@ -60,35 +149,45 @@ func (m *MemoryClient) listContains(name string) bool {
 }
 
 //InternalSelectJob selects a job and marks it as running.
-func (m *MemoryClient) InternalSelectJob() (*jobinator.Job, error) {
+func (m *MemoryClient) InternalSelectJob(sc jobinator.SelectConfig) (*jobinator.Job, error) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
+	full := m.fullWorkers(sc.Abandoned)
+	var selected *jobinator.Job
 	for _, x := range m.jobs {
-		if m.listContains(x.Name) {
-			if x.Status == status.Retry {
-				x.Status = status.Running
-				return x, nil
-			}
-			if x.Status == status.Pending {
-				if !x.Repeat {
-					x.Status = status.Running
-					return x, nil
-				}
-				if time.Now().Unix() >= x.NextRun {
-					x.Status = status.Running
-					return x, nil
-				}
+		if m.listContains(x.Name) && !full[x.Name] && inQueues(x, sc.Queues) && isReady(x) {
+			if selected == nil || runsBefore(x, selected) {
+				selected = x
 			}
 		}
 	}
-	return nil, nil
+	if selected != nil {
+		if b, ok := m.buckets[selected.Name]; ok {
+			b.take(time.Now())
+		}
+		m.update(selected, func() {
+			selected.Status = status.Running
+			selected.StartedAt = time.Now().Unix()
+			selected.LockedBy = sc.WorkerID
+			selected.LeaseExpiresAt = 0
+			if sc.LeaseDuration > 0 {
+				selected.LeaseExpiresAt = time.Now().Add(sc.LeaseDuration).Unix()
+			}
+		})
+	}
+	return selected, nil
 }
 
-//SetStatus updates the job status.
-func (m *MemoryClient) SetStatus(j *jobinator.Job, status int) error {
+//SetStatus updates the job status. Cancelled jobs keep their status.
+func (m *MemoryClient) SetStatus(j *jobinator.Job, s int) error {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
-	j.Status = status
+	if j.Status == status.Cancelled {
+		return nil
+	}
+	m.update(j, func() {
+		j.Status = s
+	})
 	return nil
 }
 
@@ -100,33 +199,34 @@ func (m *MemoryClient) IncRetryCount(j *jobinator.Job) error {
 	return nil
 }
 
-//InternalPendingJobs returns all pending jobs
+//InternalPendingJobs returns all jobs that are waiting to run and due
 func (m *MemoryClient) InternalPendingJobs() ([]*jobinator.Job, error) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
 	jobs := []*jobinator.Job{}
 	for _, x := range m.jobs {
-		if x.Status == status.Retry {
+		if isReady(x) {
 			jobs = append(jobs, x)
 		}
-		if x.Status == status.Pending {
-			if !x.Repeat {
-				jobs = append(jobs, x)
-			} else {
-				if x.NextRun > time.Now().Unix() {
-					jobs = append(jobs, x)
-				}
-			}
-		}
 	}
 	return jobs, nil
 }
 
 //InternalRegisterWorker adds the worker to the list of workers internally
-func (m *MemoryClient) InternalRegisterWorker(name string, wf jobinator.WorkerFunc) {
+func (m *MemoryClient) InternalRegisterWorker(name string, wf jobinator.WorkerFunc, config jobinator.WorkerConfig) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
 	m.wfList = append(m.wfList, name)
+	if config.MaxConcurrency > 0 {
+		m.limits[name] = config.MaxConcurrency
+	} else {
+		delete(m.limits, name)
+	}
+	if config.RateLimit.Limit > 0 {
+		m.buckets[name] = newBucket(config.RateLimit)
+	} else {
+		delete(m.buckets, name)
+	}
 }
 
 //SetError sets the job's error status.
@@ -142,7 +242,17 @@ func (m *MemoryClient) SetError(j *jobinator.Job, errtxt string, stack string) e
 func (m *MemoryClient) SetFinishedAt(j *jobinator.Job, t int64) error {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
-	j.FinishedAt = t
+	m.update(j, func() {
+		j.FinishedAt = t
+	})
+	return nil
+}
+
+//SetResult stores the result set by the job's worker
+func (m *MemoryClient) SetResult(j *jobinator.Job, result []byte) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	j.Result = result
 	return nil
 }
 
@@ -160,7 +270,7 @@ func (m *MemoryClient) InternalCleanup(config jobinator.CleanUpConfig) error {
 	defer m.joblock.Unlock()
 	deleteList := []int{}
 	for x, y := range m.jobs {
-		if y.Status == status.Done || (y.Status == status.Failed && config.IncludeFailed) {
+		if y.Status == status.Done || y.Status == status.Cancelled || ((y.Status == status.Failed || y.Status == status.Timeout) && config.IncludeFailed) {
 			if time.Now().Unix() > y.FinishedAt+int64(config.MaxAge.Seconds()) {
 				deleteList = append(deleteList, x)
 			}
@@ -176,17 +286,352 @@ func (m *MemoryClient) InternalCleanup(config jobinator.CleanUpConfig) error {
 		}
 		if !contains {
 			newJobList = append(newJobList, y)
+		} else {
+			m.stats.add(y, -1)
 		}
 	}
 	m.jobs = newJobList
+	//batches are kept until their callback job has finished, so it can still look them up
+	for id, b := range m.batches {
+		if b.Finished() && time.Now().Unix() > b.FinishedAt+int64(config.MaxAge.Seconds()) && !m.unfinished(b.CallbackJobID) {
+			delete(m.batches, id)
+		}
+	}
 	return nil
 }
 
+//unfinished returns whether the job with the given ID exists and hasn't finished yet. Callers must hold joblock.
+func (m *MemoryClient) unfinished(id string) bool {
+	for _, x := range m.jobs {
+		if x.ID == id {
+			return !status.Finished(x.Status)
+		}
+	}
+	return false
+}
+
 func (m *MemoryClient) GetNamedJob(name string) (*jobinator.Job, error) {
 	for _, x := range m.jobs {
 		if x.NamedJob == name {
 			return x, nil
 		}
 	}
-	return nil, errors.New("Job not found")
+	return nil, jobinator.ErrJobNotFound
+}
+
+//RenewLease extends the lease of a running job, as long as it is still locked by the worker.
+func (m *MemoryClient) RenewLease(j *jobinator.Job, workerID string, expiresAt int64) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	if j.Status != status.Running || j.LockedBy != workerID {
+		return jobinator.ErrLeaseLost
+	}
+	j.LeaseExpiresAt = expiresAt
+	return nil
+}
+
+//InternalReapExpiredJobs requeues running jobs whose lease has expired, or fails them if they are out of retries.
+func (m *MemoryClient) InternalReapExpiredJobs() (int, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	now := time.Now().Unix()
+	reaped := 0
+	for _, x := range m.jobs {
+		if x.Status == status.Running && x.LeaseExpiresAt > 0 && now > x.LeaseExpiresAt {
+			m.update(x, func() {
+				x.RetryCount++
+				x.Error = jobinator.ErrLeaseExpired.Error()
+				x.ErrorStack = ""
+				if x.RetryCount > x.MaxRetry {
+					x.Status = status.Failed
+					x.FinishedAt = now
+				} else {
+					x.Status = status.Retry
+				}
+			})
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+//InternalCancelJob marks a job that hasn't finished yet as cancelled.
+func (m *MemoryClient) InternalCancelJob(id string) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.ID == id {
+			return m.cancelJob(x)
+		}
+	}
+	return jobinator.ErrJobNotFound
+}
+
+//InternalCancelNamedJob is like InternalCancelJob, for a named job. It returns the ID of the job.
+func (m *MemoryClient) InternalCancelNamedJob(name string) (string, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.NamedJob == name {
+			return x.ID, m.cancelJob(x)
+		}
+	}
+	return "", jobinator.ErrJobNotFound
+}
+
+//cancelJob marks a job that hasn't finished yet as cancelled. Callers must hold joblock.
+func (m *MemoryClient) cancelJob(j *jobinator.Job) error {
+	switch j.Status {
+	case status.Pending, status.Retry, status.Running, status.Waiting:
+		m.update(j, func() {
+			j.Status = status.Cancelled
+			j.FinishedAt = time.Now().Unix()
+		})
+		return nil
+	}
+	return jobinator.ErrJobFinished
+}
+
+//InternalRetryJob resets a failed or timed out job and puts it back into the queue.
+func (m *MemoryClient) InternalRetryJob(id string) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.ID == id {
+			if !hasFailed(x) {
+				return jobinator.ErrJobNotFailed
+			}
+			m.retryJobs([]*jobinator.Job{x})
+			return nil
+		}
+	}
+	return jobinator.ErrJobNotFound
+}
+
+//InternalRetryFailed is like InternalRetryJob, for every failed or timed out job matching the filter.
+func (m *MemoryClient) InternalRetryFailed(filter jobinator.JobFilter) (int, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	jobs := []*jobinator.Job{}
+	for _, x := range m.jobs {
+		if hasFailed(x) && backend.Matches(filter, x) {
+			jobs = append(jobs, x)
+		}
+	}
+	m.retryJobs(jobs)
+	return len(jobs), nil
+}
+
+//hasFailed returns whether a job has failed or timed out.
+func hasFailed(j *jobinator.Job) bool {
+	return j.Status == status.Failed || j.Status == status.Timeout
+}
+
+//retryJobs resets jobs so they run again as if they had just been enqueued. Jobs of batches are no longer counted as finished. Their dependencies are checked once all of them have been reset, so jobs retried together with the jobs they depend on wait for them. Callers must hold joblock.
+func (m *MemoryClient) retryJobs(jobs []*jobinator.Job) {
+	for _, j := range jobs {
+		m.batchJobRetried(j)
+		m.update(j, func() {
+			j.Status = status.Pending
+			if len(j.DependsOn) > 0 {
+				j.Status = status.Waiting
+			}
+			j.RetryCount = 0
+			j.Error = ""
+			j.ErrorStack = ""
+			j.NextRun = time.Now().Unix()
+			j.LockedBy = ""
+			j.LeaseExpiresAt = 0
+		})
+	}
+	for _, j := range jobs {
+		if j.Status != status.Waiting {
+			continue
+		}
+		s, _ := m.dependencyStatus(j, false)
+		if s != status.Waiting {
+			m.update(j, func() {
+				setDependencyStatus(j, s)
+			})
+		}
+	}
+}
+
+//InternalGetJob returns a copy of the job with the given ID.
+func (m *MemoryClient) InternalGetJob(id string) (*jobinator.Job, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.ID == id {
+			j := *x
+			return &j, nil
+		}
+	}
+	return nil, jobinator.ErrJobNotFound
+}
+
+//InternalListJobs returns copies of the jobs matching the query.
+func (m *MemoryClient) InternalListJobs(q jobinator.ListQuery) ([]*jobinator.Job, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	after := &jobinator.Job{
+		CreatedAt: q.AfterCreatedAt,
+		ID:        q.AfterID,
+	}
+	jobs := []*jobinator.Job{}
+	for _, x := range m.jobs {
+		if backend.Matches(q.Filter, x) && (q.AfterID == "" || backend.ListsBefore(after, x)) {
+			j := *x
+			jobs = append(jobs, &j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return backend.ListsBefore(jobs[a], jobs[b])
+	})
+	if len(jobs) > q.Limit {
+		jobs = jobs[:q.Limit]
+	}
+	return jobs, nil
+}
+
+//InternalWatchJob returns a channel that is closed once the job has finished. It is closed right away if the job has already finished or doesn't exist.
+func (m *MemoryClient) InternalWatchJob(id string) (<-chan struct{}, func()) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	ch := make(chan struct{})
+	for _, x := range m.jobs {
+		if x.ID == id && !status.Finished(x.Status) {
+			m.watchers[id] = append(m.watchers[id], ch)
+			return ch, func() {
+				m.unwatchJob(id, ch)
+			}
+		}
+	}
+	close(ch)
+	return ch, func() {}
+}
+
+func (m *MemoryClient) unwatchJob(id string, ch chan struct{}) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	w := m.watchers[id]
+	for i, x := range w {
+		if x == ch {
+			m.watchers[id] = append(w[:i], w[i+1:]...)
+			break
+		}
+	}
+	if len(m.watchers[id]) == 0 {
+		delete(m.watchers, id)
+	}
+}
+
+//dependencyStatus returns the status a job should have given the jobs it depends on. If strict, jobs that don't exist are an error, otherwise they are assumed to be done, since only finished jobs are cleaned up and failed ones have already failed their dependents. Callers must hold joblock.
+func (m *MemoryClient) dependencyStatus(j *jobinator.Job, strict bool) (int, error) {
+	statuses := []int{}
+	for _, id := range j.DependsOn {
+		found := false
+		for _, x := range m.jobs {
+			if x.ID == id {
+				statuses = append(statuses, x.Status)
+				found = true
+				break
+			}
+		}
+		if !found && strict {
+			return 0, jobinator.ErrJobNotFound
+		}
+	}
+	return backend.DependencyStatus(statuses), nil
+}
+
+//setDependencyStatus sets the status returned by dependencyStatus.
+func setDependencyStatus(j *jobinator.Job, s int) {
+	j.Status = s
+	if s == status.Failed {
+		j.Error = jobinator.ErrDependencyFailed.Error()
+		j.FinishedAt = time.Now().Unix()
+	}
+}
+
+//resolveDependents updates the jobs waiting for a job that has just finished. Callers must hold joblock.
+func (m *MemoryClient) resolveDependents(parent *jobinator.Job) {
+	for _, x := range m.jobs {
+		if x.Status != status.Waiting || !dependsOn(x, parent.ID) {
+			continue
+		}
+		s, _ := m.dependencyStatus(x, false)
+		if s != status.Waiting {
+			m.update(x, func() {
+				setDependencyStatus(x, s)
+			})
+		}
+	}
+}
+
+func dependsOn(j *jobinator.Job, id string) bool {
+	for _, x := range j.DependsOn {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+//uniqueKeyHeld returns whether a job holds the unique key. Callers must hold joblock.
+func (m *MemoryClient) uniqueKeyHeld(key string) bool {
+	now := time.Now().Unix()
+	for _, x := range m.jobs {
+		if x.UniqueKey != nil && *x.UniqueKey == key && backend.HoldsUniqueKey(x, now) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkJobs returns the error enqueueJob would return for one of the jobs, so a batch of jobs can be rejected before any of them is queued up. Callers must hold joblock.
+func (m *MemoryClient) checkJobs(jobs []*jobinator.Job) error {
+	keys := map[string]bool{}
+	for _, x := range jobs {
+		_, err := m.dependencyStatus(x, true)
+		if err != nil {
+			return err
+		}
+		if x.UniqueKey != nil {
+			if keys[*x.UniqueKey] || m.uniqueKeyHeld(*x.UniqueKey) {
+				return jobinator.ErrDuplicateJob
+			}
+			keys[*x.UniqueKey] = true
+		}
+	}
+	return nil
+}
+
+//fullWorkers returns the names of workers that can't start another job right now, because they are running as many jobs as their MaxConcurrency allows, counting abandoned ones, or are out of tokens for their RateLimit. Callers must hold joblock.
+func (m *MemoryClient) fullWorkers(abandoned map[string]int) map[string]bool {
+	full := map[string]bool{}
+	now := time.Now()
+	for name, b := range m.buckets {
+		if b.available(now) < 1 {
+			full[name] = true
+		}
+	}
+	if len(m.limits) == 0 {
+		return full
+	}
+	running := map[string]int{}
+	for k, v := range abandoned {
+		running[k] += v
+	}
+	for k, v := range m.stats.counts {
+		if k.status == status.Running {
+			running[k.name] += v
+		}
+	}
+	for name, limit := range m.limits {
+		if running[name] >= limit {
+			full[name] = true
+		}
+	}
+	return full
 }
@@ -1,12 +1,18 @@
 package memoryclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/status"
 )
 
 var g *jobinator.Client
@@ -72,3 +78,582 @@ func TestPendingJobs(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(jobs))
 }
+
+func TestCustomBackoff(t *testing.T) {
+	var tries int32
+	wf := func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&tries, 1)
+		return errors.New("error")
+	}
+	g.RegisterWorker("backoff", wf)
+	g.EnqueueJob("backoff", nil, jobinator.JobConfig{
+		MaxRetry: 1,
+		Backoff: jobinator.Backoff{
+			Func: func(retryCount int, err error) time.Duration {
+				return time.Hour
+			},
+		},
+	})
+	g.NewBackgroundWorker()
+	g.StartAllWorkers()
+	time.Sleep(1 * time.Second)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tries))
+}
+
+func TestScheduledJobNotPending(t *testing.T) {
+	before, err := g.PendingJobs()
+	assert.Nil(t, err)
+	g.EnqueueJob("willNotExecute", nil, jobinator.JobConfig{
+		RunAt: time.Now().Add(time.Hour),
+	})
+	after, err := g.PendingJobs()
+	assert.Nil(t, err)
+	assert.Equal(t, len(before), len(after))
+}
+
+func TestQueues(t *testing.T) {
+	var critical, bulk int32
+	g.RegisterWorker("critical", func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&critical, 1)
+		return nil
+	})
+	g.RegisterWorker("bulk", func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&bulk, 1)
+		return nil
+	})
+	g.EnqueueJob("critical", nil, jobinator.JobConfig{
+		Queue: "critical",
+	})
+	g.EnqueueJob("bulk", nil, jobinator.JobConfig{})
+	g.NewBackgroundWorker("critical")
+	g.StartAllWorkers()
+	time.Sleep(1 * time.Second)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&critical))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&bulk))
+	g.NewBackgroundWorker(jobinator.DefaultQueue)
+	g.StartAllWorkers()
+	time.Sleep(1 * time.Second)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bulk))
+}
+
+func TestPriority(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	c.RegisterWorker("prio", func(j *jobinator.JobRef) error {
+		return nil
+	})
+	for _, p := range []int{0, 5, 1, 5} {
+		c.EnqueueJob("prio", p, jobinator.JobConfig{
+			Priority: p,
+		})
+	}
+	order := []int{}
+	for i := 0; i < 4; i++ {
+		j, err := c.InternalSelectJob(jobinator.SelectConfig{})
+		assert.Nil(t, err)
+		order = append(order, j.Priority)
+	}
+	assert.Equal(t, []int{5, 5, 1, 0}, order)
+}
+
+func TestRetryJob(t *testing.T) {
+	var fixed int32
+	var runs int32
+	wf := func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&runs, 1)
+		if atomic.LoadInt32(&fixed) == 0 {
+			return errors.New("downstream outage")
+		}
+		return nil
+	}
+	g.RegisterWorker("outage", wf)
+	g.EnqueueJob("outage", nil, jobinator.JobConfig{
+		Identifier: "outage",
+	})
+	g.NewBackgroundWorker()
+	g.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	g.DestroyAllWorkers()
+	j, err := g.GetNamedJob("outage")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	atomic.StoreInt32(&fixed, 1)
+	n, err := g.RetryAllFailed(jobinator.JobFilter{
+		Name: "outage",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	g.NewBackgroundWorker()
+	g.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	g.DestroyAllWorkers()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&runs))
+	j, err = g.GetNamedJob("outage")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Done, j.Status)
+	assert.Equal(t, 0, j.RetryCount)
+	err = g.RetryJob(j.ID)
+	assert.Equal(t, jobinator.ErrJobNotFailed, err)
+}
+
+func TestListJobs(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{})
+	for i := 0; i < 3; i++ {
+		_, err := c.InternalEnqueueJob(&jobinator.Job{
+			ID:         fmt.Sprintf("job_%d", i),
+			Name:       "list",
+			CreatedAt:  int64(i),
+			FinishedAt: int64(i + 1),
+			Status:     status.Done,
+		})
+		assert.Nil(t, err)
+	}
+	jobs, cursor, err := c.ListJobs(jobinator.ListConfig{
+		Limit: 2,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(jobs))
+	assert.Equal(t, "job_2", jobs[0].ID)
+	assert.Equal(t, "job_1", jobs[1].ID)
+	jobs, cursor, err = c.ListJobs(jobinator.ListConfig{
+		Cursor: cursor,
+		Limit:  2,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, "job_0", jobs[0].ID)
+	assert.Equal(t, "", cursor)
+	jobs, _, err = c.ListJobs(jobinator.ListConfig{
+		Filter: jobinator.JobFilter{
+			FinishedBefore: time.Unix(3, 0),
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(jobs))
+	jobs[0].Status = status.Failed
+	j, err := c.GetJob(jobs[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Done, j.Status)
+}
+
+func TestStats(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{})
+	now := time.Now().Unix()
+	jobs := []*jobinator.Job{
+		{ID: "a", Name: "stats", Queue: "bulk", Status: status.Pending, CreatedAt: now - 60},
+		{ID: "b", Name: "stats", Queue: "bulk", Status: status.Pending, CreatedAt: now, NextRun: now + 3600},
+		{ID: "c", Name: "stats", Queue: "critical", Status: status.Done, StartedAt: now - 10, FinishedAt: now - 6},
+		{ID: "d", Name: "other", Queue: "critical", Status: status.Done, StartedAt: now - 10, FinishedAt: now - 8},
+	}
+	for _, x := range jobs {
+		_, err := c.InternalEnqueueJob(x)
+		assert.Nil(t, err)
+	}
+	err := c.CancelJob("b")
+	assert.Nil(t, err)
+	s, err := c.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, s.Statuses.Total())
+	assert.Equal(t, 1, s.Statuses[status.Pending])
+	assert.Equal(t, 1, s.Statuses[status.Cancelled])
+	assert.Equal(t, 2, s.Statuses[status.Done])
+	assert.Equal(t, 3, s.Names["stats"].Total())
+	assert.Equal(t, 1, s.Names["other"][status.Done])
+	assert.Equal(t, 2, s.Queues["bulk"].Total())
+	assert.Equal(t, 2, s.Queues["critical"][status.Done])
+	assert.Equal(t, time.Second*3, s.AverageRunTime)
+	assert.True(t, s.OldestPending >= time.Minute)
+	err = c.CleanUp(jobinator.CleanUpConfig{})
+	assert.Nil(t, err)
+	s, err = c.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, s.Statuses[status.Done])
+	assert.Equal(t, time.Duration(0), s.AverageRunTime)
+}
+
+func TestFuture(t *testing.T) {
+	//workers and futures would only poll once an hour, so the test can only pass if they are notified
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Hour,
+	})
+	c.RegisterWorker("double", func(j *jobinator.JobRef) error {
+		n := 0
+		err := j.ScanArgs(&n)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.New("negative")
+		}
+		return j.SetResult(n * 2)
+	})
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	defer c.DestroyAllWorkers()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := c.EnqueueFuture("double", 21, jobinator.JobConfig{})
+	assert.Nil(t, err)
+	result, err := f.Wait(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", string(result))
+	f, err = c.EnqueueFuture("double", -1, jobinator.JobConfig{})
+	assert.Nil(t, err)
+	_, err = f.Wait(ctx)
+	jerr, ok := err.(*jobinator.JobError)
+	assert.True(t, ok)
+	assert.Equal(t, status.Failed, jerr.Status)
+	assert.Equal(t, "negative", jerr.Message)
+}
+
+func TestEnqueueJobs(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{})
+	results, err := c.EnqueueJobs([]jobinator.JobSpec{
+		{Name: "batch", Args: 1},
+		{Name: "batch", Args: 2, Config: jobinator.JobConfig{Identifier: "batch"}},
+		{Name: "batch", Args: 3, Config: jobinator.JobConfig{Identifier: "batch"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.True(t, results[1].Created)
+	assert.False(t, results[2].Created)
+	assert.Equal(t, results[1].ID, results[2].ID)
+	j, err := c.GetJob(results[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(j.Args))
+	_, err = c.EnqueueJobs([]jobinator.JobSpec{
+		{Name: "batch"},
+		{Name: "batch", Config: jobinator.JobConfig{Cron: "invalid"}},
+	})
+	assert.NotNil(t, err)
+	s, err := c.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.Statuses.Total())
+}
+
+func TestDependencies(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	order := []string{}
+	orderLock := sync.Mutex{}
+	c.RegisterWorker("step", func(j *jobinator.JobRef) error {
+		name := ""
+		err := j.ScanArgs(&name)
+		if err != nil {
+			return err
+		}
+		if name == "fail" {
+			return errors.New("fail")
+		}
+		orderLock.Lock()
+		order = append(order, name)
+		orderLock.Unlock()
+		return nil
+	})
+	enqueue := func(name string, dependsOn ...string) string {
+		res, err := c.Enqueue("step", name, jobinator.JobConfig{
+			DependsOn: dependsOn,
+		})
+		assert.Nil(t, err)
+		return res.ID
+	}
+	fetch := enqueue("fetch")
+	parse := enqueue("parse", fetch)
+	store := enqueue("store", fetch, parse)
+	fail := enqueue("fail")
+	skipped := enqueue("skipped", fail)
+	skippedToo := enqueue("skipped too", skipped)
+	_, err := c.Enqueue("step", "missing", jobinator.JobConfig{
+		DependsOn: []string{"missing"},
+	})
+	assert.Equal(t, jobinator.ErrJobNotFound, err)
+	j, err := c.GetJob(store)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Waiting, j.Status)
+	c.NewBackgroundWorker()
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second)
+	c.DestroyAllWorkers()
+	orderLock.Lock()
+	assert.Equal(t, []string{"fetch", "parse", "store"}, order)
+	orderLock.Unlock()
+	for _, x := range []string{fetch, parse, store} {
+		j, err := c.GetJob(x)
+		assert.Nil(t, err)
+		assert.Equal(t, status.Done, j.Status)
+	}
+	for _, x := range []string{skipped, skippedToo} {
+		j, err := c.GetJob(x)
+		assert.Nil(t, err)
+		assert.Equal(t, status.Failed, j.Status)
+		assert.Equal(t, jobinator.ErrDependencyFailed.Error(), j.Error)
+	}
+}
+
+func TestRetryWithDependencies(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	var parentFails int32 = 1
+	var parentRunning int32
+	var childRanEarly int32
+	c.RegisterWorker("parent", func(j *jobinator.JobRef) error {
+		if atomic.LoadInt32(&parentFails) == 1 {
+			return errors.New("outage")
+		}
+		atomic.StoreInt32(&parentRunning, 1)
+		time.Sleep(time.Second / 2)
+		atomic.StoreInt32(&parentRunning, 0)
+		return nil
+	})
+	c.RegisterWorker("child", func(j *jobinator.JobRef) error {
+		if atomic.LoadInt32(&parentRunning) == 1 {
+			atomic.StoreInt32(&childRanEarly, 1)
+		}
+		return nil
+	})
+	parent, err := c.Enqueue("parent", nil, jobinator.JobConfig{})
+	assert.Nil(t, err)
+	child, err := c.Enqueue("child", nil, jobinator.JobConfig{
+		DependsOn: []string{parent.ID},
+	})
+	assert.Nil(t, err)
+	c.NewBackgroundWorker()
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	j, err := c.GetJob(child.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Failed, j.Status)
+	atomic.StoreInt32(&parentFails, 0)
+	c.StopAllWorkersBlocking()
+	n, err := c.RetryAllFailed(jobinator.JobFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	j, err = c.GetJob(child.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Waiting, j.Status)
+	c.StartAllWorkers()
+	time.Sleep(time.Second * 2)
+	c.DestroyAllWorkers()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&childRanEarly))
+	for _, x := range []string{parent.ID, child.ID} {
+		j, err := c.GetJob(x)
+		assert.Nil(t, err)
+		assert.Equal(t, status.Done, j.Status)
+	}
+}
+
+func TestBatchHook(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	c.RegisterWorker("member", func(j *jobinator.JobRef) error {
+		fail := false
+		err := j.ScanArgs(&fail)
+		if err != nil {
+			return err
+		}
+		if fail {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	batches := make(chan jobinator.Batch, 2)
+	c.RegisterBatchHook("report", func(b *jobinator.Batch) error {
+		batches <- *b
+		return nil
+	})
+	specs := []jobinator.JobSpec{}
+	for i := 0; i < 5; i++ {
+		specs = append(specs, jobinator.JobSpec{
+			Name: "member",
+			Args: i == 0,
+		})
+	}
+	b, results, err := c.EnqueueBatch(specs, jobinator.BatchConfig{
+		Hook: "report",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(results))
+	c.NewBackgroundWorker()
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	defer c.DestroyAllWorkers()
+	select {
+	case finished := <-batches:
+		assert.Equal(t, b.ID, finished.ID)
+		assert.Equal(t, 4, finished.Succeeded)
+		assert.Equal(t, 1, finished.Failed)
+		assert.True(t, finished.Finished())
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch hook wasn't called")
+	}
+	time.Sleep(time.Second / 2)
+	assert.Equal(t, 0, len(batches))
+}
+
+func TestRetryBatchJob(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 10,
+	})
+	var flakyFails int32 = 1
+	c.RegisterWorker("flaky", func(j *jobinator.JobRef) error {
+		if atomic.LoadInt32(&flakyFails) == 1 {
+			return errors.New("flaky")
+		}
+		return nil
+	})
+	c.RegisterWorker("slow", func(j *jobinator.JobRef) error {
+		time.Sleep(time.Second * 2)
+		return nil
+	})
+	var callbacks int32
+	c.RegisterWorker("batch_done", func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&callbacks, 1)
+		return nil
+	})
+	b, results, err := c.EnqueueBatch([]jobinator.JobSpec{
+		{Name: "flaky"},
+		{Name: "slow"},
+	}, jobinator.BatchConfig{
+		Callback: &jobinator.JobSpec{
+			Name: "batch_done",
+		},
+	})
+	assert.Nil(t, err)
+	c.NewBackgroundWorker()
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(time.Second / 2)
+	atomic.StoreInt32(&flakyFails, 0)
+	err = c.RetryJob(results[0].ID)
+	assert.Nil(t, err)
+	time.Sleep(time.Second / 2)
+	//the retried job is only counted once, so the batch waits for the slow job
+	nb, err := c.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.False(t, nb.Finished())
+	assert.Equal(t, 1, nb.Succeeded)
+	assert.Equal(t, 0, nb.Failed)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&callbacks))
+	time.Sleep(time.Second * 2)
+	c.DestroyAllWorkers()
+	nb, err = c.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.True(t, nb.Finished())
+	assert.Equal(t, 2, nb.Succeeded)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&callbacks))
+}
+
+func TestBatchFinishedOnEnqueue(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{})
+	parent, err := c.Enqueue("parent", nil, jobinator.JobConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, c.CancelJob(parent.ID))
+	//the only job of the batch fails right away, so the batch finishes while it is queued up
+	b, _, err := c.EnqueueBatch([]jobinator.JobSpec{
+		{Name: "child", Config: jobinator.JobConfig{DependsOn: []string{parent.ID}}},
+	}, jobinator.BatchConfig{
+		Callback: &jobinator.JobSpec{
+			Name: "batch_done",
+		},
+	})
+	assert.Nil(t, err)
+	b, err = c.GetBatch(b.ID)
+	assert.Nil(t, err)
+	assert.True(t, b.Finished())
+	assert.Equal(t, 1, b.Failed)
+	j, err := c.GetJob(b.CallbackJobID)
+	assert.Nil(t, err)
+	assert.Equal(t, status.Pending, j.Status)
+}
+
+func TestUniqueJobs(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{})
+	config := jobinator.JobConfig{
+		Unique: &jobinator.Unique{},
+	}
+	first, err := c.Enqueue("unique", 1, config)
+	assert.Nil(t, err)
+	_, err = c.Enqueue("unique", 1, config)
+	assert.Equal(t, jobinator.ErrDuplicateJob, err)
+	_, err = c.EnqueueJobs([]jobinator.JobSpec{
+		{Name: "unique", Args: 2, Config: config},
+		{Name: "unique", Args: 2, Config: config},
+	})
+	assert.Equal(t, jobinator.ErrDuplicateJob, err)
+	err = c.CancelJob(first.ID)
+	assert.Nil(t, err)
+	_, err = c.Enqueue("unique", 1, config)
+	assert.Nil(t, err)
+	s, err := c.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.Statuses.Total())
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 20,
+	})
+	var running, maxRunning, done int32
+	c.RegisterWorkerWithConfig("limited", func(j *jobinator.JobRef) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Second / 5)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&done, 1)
+		return nil
+	}, jobinator.WorkerConfig{
+		MaxConcurrency: 2,
+	})
+	for i := 0; i < 6; i++ {
+		c.EnqueueJob("limited", nil, jobinator.JobConfig{})
+	}
+	for i := 0; i < 4; i++ {
+		c.NewBackgroundWorker()
+	}
+	c.StartAllWorkers()
+	time.Sleep(2 * time.Second)
+	c.DestroyAllWorkers()
+	assert.Equal(t, int32(6), atomic.LoadInt32(&done))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestRateLimit(t *testing.T) {
+	c := NewMemoryClient(jobinator.ClientConfig{
+		WorkerSleepTime: time.Second / 20,
+	})
+	var done int32
+	c.RegisterWorkerWithConfig("limited", func(j *jobinator.JobRef) error {
+		atomic.AddInt32(&done, 1)
+		return nil
+	}, jobinator.WorkerConfig{
+		RateLimit: jobinator.RateLimit{
+			Limit: 2,
+			Per:   time.Second,
+		},
+	})
+	for i := 0; i < 10; i++ {
+		c.EnqueueJob("limited", nil, jobinator.JobConfig{})
+	}
+	c.NewBackgroundWorker()
+	c.NewBackgroundWorker()
+	c.StartAllWorkers()
+	time.Sleep(1200 * time.Millisecond)
+	c.DestroyAllWorkers()
+	//2 jobs right away, then one every half a second
+	n := atomic.LoadInt32(&done)
+	assert.True(t, n >= 3 && n <= 5, "%d jobs done", n)
+}
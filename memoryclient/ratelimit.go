@@ -0,0 +1,34 @@
+package memoryclient
+
+import (
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
+)
+
+//bucket is the in-process token bucket of a rate limited worker
+type bucket struct {
+	limit  jobinator.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit jobinator.RateLimit) *bucket {
+	return &bucket{
+		limit:  limit,
+		tokens: backend.MaxTokens(limit),
+		last:   time.Now(),
+	}
+}
+
+//available returns how many tokens the bucket holds now.
+func (b *bucket) available(now time.Time) float64 {
+	return backend.Refill(b.limit, b.tokens, now.Sub(b.last))
+}
+
+//take takes a token from the bucket.
+func (b *bucket) take(now time.Time) {
+	b.tokens = b.available(now) - 1
+	b.last = now
+}
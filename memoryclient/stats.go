@@ -0,0 +1,87 @@
+package memoryclient
+
+import (
+	"time"
+
+	"github.com/blasphemy/jobinator"
+	"github.com/blasphemy/jobinator/internal/backend"
+	"github.com/blasphemy/jobinator/status"
+)
+
+type statsKey struct {
+	name   string
+	queue  string
+	status int
+}
+
+//stats are counters kept up to date as jobs change, so InternalStats doesn't have to look at every job.
+type stats struct {
+	counts  map[statsKey]int
+	runTime int64 //total seconds between starting and finishing, over the jobs that are done
+	runs    int
+}
+
+func newStats() *stats {
+	return &stats{
+		counts: make(map[statsKey]int),
+	}
+}
+
+func (s *stats) add(j *jobinator.Job, n int) {
+	k := statsKey{j.Name, j.Queue, j.Status}
+	s.counts[k] += n
+	if s.counts[k] == 0 {
+		delete(s.counts, k)
+	}
+	if j.Status == status.Done && j.StartedAt > 0 {
+		s.runTime += int64(n) * (j.FinishedAt - j.StartedAt)
+		s.runs += n
+	}
+}
+
+//update changes a job while keeping the counters in sync. Once the job has finished, its watchers are notified and its dependents resolved. Callers must hold joblock.
+func (m *MemoryClient) update(j *jobinator.Job, f func()) {
+	m.stats.add(j, -1)
+	f()
+	m.stats.add(j, 1)
+	if status.Finished(j.Status) {
+		for _, x := range m.watchers[j.ID] {
+			close(x)
+		}
+		delete(m.watchers, j.ID)
+		m.batchJobFinished(j)
+		m.resolveDependents(j)
+	}
+}
+
+//InternalStats returns the job counts from the counters. Only the oldest pending job has to be searched for.
+func (m *MemoryClient) InternalStats() (jobinator.Stats, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	s := jobinator.Stats{}
+	for k, v := range m.stats.counts {
+		backend.AddCount(&s, k.name, k.queue, k.status, v)
+	}
+	if m.stats.runs > 0 {
+		s.AverageRunTime = time.Duration(m.stats.runTime) * time.Second / time.Duration(m.stats.runs)
+	}
+	if s.Statuses[status.Pending]+s.Statuses[status.Retry] > 0 {
+		now := time.Now().Unix()
+		oldest := now
+		for _, x := range m.jobs {
+			if isReady(x) && dueSince(x) < oldest {
+				oldest = dueSince(x)
+			}
+		}
+		s.OldestPending = time.Duration(now-oldest) * time.Second
+	}
+	return s, nil
+}
+
+//dueSince returns when a job became due.
+func dueSince(j *jobinator.Job) int64 {
+	if j.NextRun > j.CreatedAt {
+		return j.NextRun
+	}
+	return j.CreatedAt
+}
@@ -1,7 +1,7 @@
 package jobinator
 
 import (
-	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,7 +11,10 @@ import (
 type MockClient struct {
 	joblock sync.Mutex
 	jobs    []*Job
+	batches map[string]*Batch
 	wfList  []string
+	limits  map[string]int
+	notify  func()
 }
 
 func newMockClient(c ClientConfig) *Client {
@@ -19,13 +22,40 @@ func newMockClient(c ClientConfig) *Client {
 		joblock: sync.Mutex{},
 		jobs:    []*Job{},
 		wfList:  []string{},
+		limits:  make(map[string]int),
+		batches: make(map[string]*Batch),
 	}
 	return NewClient(mc, c)
 }
 
-func (m *MockClient) InternalEnqueueJob(j *Job) error {
+func (m *MockClient) InternalSetNotifier(notify func()) {
+	m.notify = notify
+}
+
+func (m *MockClient) InternalEnqueueJob(j *Job) (bool, error) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
+	return m.enqueueJob(j)
+}
+
+func (m *MockClient) InternalEnqueueJobs(jobs []*Job) ([]bool, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	//nothing may be queued up if one of the jobs can't be
+	for _, x := range jobs {
+		_, err := m.dependencyStatus(x, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	created := make([]bool, len(jobs))
+	for i, x := range jobs {
+		created[i], _ = m.enqueueJob(x)
+	}
+	return created, nil
+}
+
+func (m *MockClient) enqueueJob(j *Job) (bool, error) {
 	if j.NamedJob != "" {
 		for _, x := range m.jobs {
 			if x.NamedJob == j.NamedJob {
@@ -34,15 +64,39 @@ func (m *MockClient) InternalEnqueueJob(j *Job) error {
 				x.Repeat = j.Repeat
 				x.RepeatInterval = j.RepeatInterval
 				x.Name = j.Name
-				if j.Repeat {
+				x.Timeout = j.Timeout
+				x.BackoffStrategy = j.BackoffStrategy
+				x.BackoffDelay = j.BackoffDelay
+				x.BackoffMaxDelay = j.BackoffMaxDelay
+				x.BackoffJitter = j.BackoffJitter
+				x.Cron = j.Cron
+				x.Queue = j.Queue
+				x.Priority = j.Priority
+				if j.Repeat && j.Cron == "" {
 					x.NextRun = x.FinishedAt + int64(j.RepeatInterval.Seconds())
+				} else {
+					x.NextRun = j.NextRun
 				}
-				return nil
+				j.ID = x.ID
+				return false, nil
 			}
 		}
 	}
+	if len(j.DependsOn) > 0 {
+		s, err := m.dependencyStatus(j, true)
+		if err != nil {
+			return false, err
+		}
+		setDependencyStatus(j, s)
+	}
+	if j.UniqueKey != nil && m.uniqueKeyHeld(*j.UniqueKey) {
+		return false, ErrDuplicateJob
+	}
 	m.jobs = append(m.jobs, j)
-	return nil
+	if status.Finished(j.Status) {
+		m.jobFinished(j)
+	}
+	return true, nil
 }
 
 func (m *MockClient) InternalMarkJobFinished(j *Job) error {
@@ -57,50 +111,75 @@ func (m *MockClient) InternalPendingJobs() ([]*Job, error) {
 	defer m.joblock.Unlock()
 	jobs := []*Job{}
 	for _, x := range m.jobs {
-		if x.Status == status.Retry {
+		if isReady(x) {
 			jobs = append(jobs, x)
 		}
-		if x.Status == status.Pending {
-			if !x.Repeat {
-				jobs = append(jobs, x)
-			} else {
-				if x.NextRun > time.Now().Unix() {
-					jobs = append(jobs, x)
-				}
-			}
-		}
 	}
 	return jobs, nil
 }
 
-func (m *MockClient) InternalRegisterWorker(name string, wf WorkerFunc) {
+func (m *MockClient) InternalRegisterWorker(name string, wf WorkerFunc, config WorkerConfig) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
 	m.wfList = append(m.wfList, name)
+	if config.MaxConcurrency > 0 {
+		m.limits[name] = config.MaxConcurrency
+	} else {
+		delete(m.limits, name)
+	}
 }
 
-func (m *MockClient) InternalSelectJob() (*Job, error) {
+func (m *MockClient) InternalSelectJob(sc SelectConfig) (*Job, error) {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
+	full := m.fullWorkers(sc.Abandoned)
+	var selected *Job
 	for _, x := range m.jobs {
-		if m.listContains(x.Name) {
-			if x.Status == status.Retry {
-				x.Status = status.Running
-				return x, nil
-			}
-			if x.Status == status.Pending {
-				if !x.Repeat {
-					x.Status = status.Running
-					return x, nil
-				}
-				if time.Now().Unix() >= x.NextRun {
-					x.Status = status.Running
-					return x, nil
-				}
+		if m.listContains(x.Name) && !full[x.Name] && inQueues(x, sc.Queues) && isReady(x) {
+			if selected == nil || runsBefore(x, selected) {
+				selected = x
 			}
 		}
 	}
-	return nil, nil
+	if selected != nil {
+		selected.Status = status.Running
+		selected.StartedAt = time.Now().Unix()
+		selected.LockedBy = sc.WorkerID
+		selected.LeaseExpiresAt = 0
+		if sc.LeaseDuration > 0 {
+			selected.LeaseExpiresAt = time.Now().Add(sc.LeaseDuration).Unix()
+		}
+	}
+	return selected, nil
+}
+
+//isReady returns whether a job is waiting to run and due.
+func isReady(j *Job) bool {
+	if j.Status != status.Pending && j.Status != status.Retry {
+		return false
+	}
+	return time.Now().Unix() >= j.NextRun
+}
+
+//runsBefore returns whether a should be selected before b. Jobs that compare equal keep their order in m.jobs.
+func runsBefore(a, b *Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.EnqueuedAt < b.EnqueuedAt
+}
+
+//inQueues returns whether a job is in one of the queues, an empty list matching every queue.
+func inQueues(j *Job, queues []string) bool {
+	if len(queues) == 0 {
+		return true
+	}
+	for _, x := range queues {
+		if j.Queue == x {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *MockClient) listContains(name string) bool {
@@ -119,10 +198,16 @@ func (m *MockClient) IncRetryCount(j *Job) error {
 	return nil
 }
 
-func (m *MockClient) SetStatus(j *Job, status int) error {
+func (m *MockClient) SetStatus(j *Job, s int) error {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
-	j.Status = status
+	if j.Status == status.Cancelled {
+		return nil
+	}
+	j.Status = s
+	if status.Finished(s) {
+		m.jobFinished(j)
+	}
 	return nil
 }
 
@@ -141,6 +226,13 @@ func (m *MockClient) SetFinishedAt(j *Job, t int64) error {
 	return nil
 }
 
+func (m *MockClient) SetResult(j *Job, result []byte) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	j.Result = result
+	return nil
+}
+
 func (m *MockClient) SetNextRun(j *Job, t int64) error {
 	m.joblock.Lock()
 	defer m.joblock.Unlock()
@@ -153,7 +245,7 @@ func (m *MockClient) InternalCleanup(config CleanUpConfig) error {
 	defer m.joblock.Unlock()
 	deleteList := []int{}
 	for x, y := range m.jobs {
-		if y.Status == status.Done || (y.Status == status.Failed && config.IncludeFailed) {
+		if y.Status == status.Done || y.Status == status.Cancelled || ((y.Status == status.Failed || y.Status == status.Timeout) && config.IncludeFailed) {
 			if time.Now().Unix() > y.FinishedAt+int64(config.MaxAge.Seconds()) {
 				deleteList = append(deleteList, x)
 			}
@@ -181,5 +273,362 @@ func (m *MockClient) GetNamedJob(name string) (*Job, error) {
 			return x, nil
 		}
 	}
-	return nil, errors.New("Job not found")
+	return nil, ErrJobNotFound
+}
+
+func (m *MockClient) RenewLease(j *Job, workerID string, expiresAt int64) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	if j.Status != status.Running || j.LockedBy != workerID {
+		return ErrLeaseLost
+	}
+	j.LeaseExpiresAt = expiresAt
+	return nil
+}
+
+func (m *MockClient) InternalReapExpiredJobs() (int, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	now := time.Now().Unix()
+	reaped := 0
+	for _, x := range m.jobs {
+		if x.Status == status.Running && x.LeaseExpiresAt > 0 && now > x.LeaseExpiresAt {
+			x.RetryCount++
+			x.Error = ErrLeaseExpired.Error()
+			x.ErrorStack = ""
+			if x.RetryCount > x.MaxRetry {
+				x.Status = status.Failed
+				x.FinishedAt = now
+			} else {
+				x.Status = status.Retry
+			}
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+func (m *MockClient) InternalCancelJob(id string) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.ID == id {
+			return m.cancelJob(x)
+		}
+	}
+	return ErrJobNotFound
+}
+
+func (m *MockClient) InternalCancelNamedJob(name string) (string, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.NamedJob == name {
+			return x.ID, m.cancelJob(x)
+		}
+	}
+	return "", ErrJobNotFound
+}
+
+func (m *MockClient) cancelJob(j *Job) error {
+	switch j.Status {
+	case status.Pending, status.Retry, status.Running, status.Waiting:
+		j.Status = status.Cancelled
+		j.FinishedAt = time.Now().Unix()
+		m.jobFinished(j)
+		return nil
+	}
+	return ErrJobFinished
+}
+
+func (m *MockClient) InternalRetryJob(id string) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.ID == id {
+			if !hasFailed(x) {
+				return ErrJobNotFailed
+			}
+			m.retryJobs([]*Job{x})
+			return nil
+		}
+	}
+	return ErrJobNotFound
+}
+
+func (m *MockClient) InternalRetryFailed(filter JobFilter) (int, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	jobs := []*Job{}
+	for _, x := range m.jobs {
+		if hasFailed(x) && matches(filter, x) {
+			jobs = append(jobs, x)
+		}
+	}
+	m.retryJobs(jobs)
+	return len(jobs), nil
+}
+
+func hasFailed(j *Job) bool {
+	return j.Status == status.Failed || j.Status == status.Timeout
+}
+
+func (m *MockClient) retryJobs(jobs []*Job) {
+	for _, j := range jobs {
+		if b, ok := m.batches[j.BatchID]; ok && b.CallbackJobID != j.ID && !b.Finished() {
+			if j.Status == status.Done {
+				b.Succeeded--
+			} else {
+				b.Failed--
+			}
+		}
+		j.Status = status.Pending
+		if len(j.DependsOn) > 0 {
+			j.Status = status.Waiting
+		}
+		j.RetryCount = 0
+		j.Error = ""
+		j.ErrorStack = ""
+		j.NextRun = time.Now().Unix()
+		j.LockedBy = ""
+		j.LeaseExpiresAt = 0
+	}
+	for _, j := range jobs {
+		if j.Status != status.Waiting {
+			continue
+		}
+		s, _ := m.dependencyStatus(j, false)
+		if s != status.Waiting {
+			setDependencyStatus(j, s)
+			if status.Finished(s) {
+				m.jobFinished(j)
+			}
+		}
+	}
+}
+
+func (m *MockClient) InternalGetJob(id string) (*Job, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	for _, x := range m.jobs {
+		if x.ID == id {
+			j := *x
+			return &j, nil
+		}
+	}
+	return nil, ErrJobNotFound
+}
+
+func (m *MockClient) InternalListJobs(q ListQuery) ([]*Job, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	after := &Job{
+		CreatedAt: q.AfterCreatedAt,
+		ID:        q.AfterID,
+	}
+	jobs := []*Job{}
+	for _, x := range m.jobs {
+		if matches(q.Filter, x) && (q.AfterID == "" || listsBefore(after, x)) {
+			j := *x
+			jobs = append(jobs, &j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return listsBefore(jobs[a], jobs[b])
+	})
+	if len(jobs) > q.Limit {
+		jobs = jobs[:q.Limit]
+	}
+	return jobs, nil
+}
+
+func (m *MockClient) InternalStats() (Stats, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	s := Stats{}
+	s.init()
+	for _, x := range m.jobs {
+		if s.Names[x.Name] == nil {
+			s.Names[x.Name] = StatusCounts{}
+		}
+		if s.Queues[x.Queue] == nil {
+			s.Queues[x.Queue] = StatusCounts{}
+		}
+		s.Statuses[x.Status]++
+		s.Names[x.Name][x.Status]++
+		s.Queues[x.Queue][x.Status]++
+	}
+	return s, nil
+}
+
+func (m *MockClient) dependencyStatus(j *Job, strict bool) (int, error) {
+	statuses := []int{}
+	for _, id := range j.DependsOn {
+		found := false
+		for _, x := range m.jobs {
+			if x.ID == id {
+				statuses = append(statuses, x.Status)
+				found = true
+				break
+			}
+		}
+		if !found && strict {
+			return 0, ErrJobNotFound
+		}
+	}
+	s := status.Pending
+	for _, x := range statuses {
+		switch x {
+		case status.Done:
+		case status.Failed, status.Timeout, status.Cancelled:
+			return status.Failed, nil
+		default:
+			s = status.Waiting
+		}
+	}
+	return s, nil
+}
+
+func setDependencyStatus(j *Job, s int) {
+	j.Status = s
+	if s == status.Failed {
+		j.Error = ErrDependencyFailed.Error()
+		j.FinishedAt = time.Now().Unix()
+	}
+}
+
+func (m *MockClient) resolveDependents(parent *Job) {
+	for _, x := range m.jobs {
+		if x.Status != status.Waiting || !dependsOn(x, parent.ID) {
+			continue
+		}
+		s, _ := m.dependencyStatus(x, false)
+		if s != status.Waiting {
+			setDependencyStatus(x, s)
+			if status.Finished(s) {
+				m.jobFinished(x)
+			}
+		}
+	}
+}
+
+func dependsOn(j *Job, id string) bool {
+	for _, x := range j.DependsOn {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockClient) jobFinished(j *Job) {
+	m.batchJobFinished(j)
+	m.resolveDependents(j)
+}
+
+func (m *MockClient) batchJobFinished(j *Job) {
+	b, ok := m.batches[j.BatchID]
+	if !ok || b.CallbackJobID == j.ID || b.Finished() {
+		return
+	}
+	if j.Status == status.Done {
+		b.Succeeded++
+	} else {
+		b.Failed++
+	}
+	if b.Succeeded+b.Failed < b.Total {
+		return
+	}
+	b.FinishedAt = time.Now().Unix()
+	for _, x := range m.jobs {
+		if x.ID == b.CallbackJobID && x.Status == status.Waiting {
+			x.Status = status.Pending
+		}
+	}
+}
+
+func (m *MockClient) InternalEnqueueBatch(b *Batch, jobs []*Job, callback *Job) error {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	nb := *b
+	m.batches[b.ID] = &nb
+	if callback != nil {
+		m.enqueueJob(callback)
+	}
+	for _, x := range jobs {
+		_, err := m.enqueueJob(x)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockClient) InternalGetBatch(id string) (*Batch, error) {
+	m.joblock.Lock()
+	defer m.joblock.Unlock()
+	b, ok := m.batches[id]
+	if !ok {
+		return nil, ErrBatchNotFound
+	}
+	nb := *b
+	return &nb, nil
+}
+
+func (m *MockClient) uniqueKeyHeld(key string) bool {
+	now := time.Now().Unix()
+	for _, x := range m.jobs {
+		if x.UniqueKey != nil && *x.UniqueKey == key && (x.UniqueUntil > now || !status.Finished(x.Status)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockClient) fullWorkers(abandoned map[string]int) map[string]bool {
+	running := map[string]int{}
+	for k, v := range abandoned {
+		running[k] += v
+	}
+	for _, x := range m.jobs {
+		if x.Status == status.Running {
+			running[x.Name]++
+		}
+	}
+	full := map[string]bool{}
+	for name, limit := range m.limits {
+		if running[name] >= limit {
+			full[name] = true
+		}
+	}
+	return full
+}
+
+func matches(f JobFilter, j *Job) bool {
+	if (f.Name != "" && j.Name != f.Name) || (f.Queue != "" && j.Queue != f.Queue) || (f.NamedJob != "" && j.NamedJob != f.NamedJob) {
+		return false
+	}
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, x := range f.Statuses {
+			found = found || j.Status == x
+		}
+		if !found {
+			return false
+		}
+	}
+	if (!f.CreatedAfter.IsZero() && j.CreatedAt <= f.CreatedAfter.Unix()) || (!f.CreatedBefore.IsZero() && j.CreatedAt >= f.CreatedBefore.Unix()) {
+		return false
+	}
+	if !f.FinishedAfter.IsZero() && j.FinishedAt <= f.FinishedAfter.Unix() {
+		return false
+	}
+	return f.FinishedBefore.IsZero() || (j.FinishedAt > 0 && j.FinishedAt < f.FinishedBefore.Unix())
+}
+
+func listsBefore(a, b *Job) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID > b.ID
 }
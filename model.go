@@ -1,40 +1,93 @@
 package jobinator
 
 import (
+	"context"
+	"sync"
 	"time"
 )
 
 //InternalClient is the interface a storage backend  has to implement. See memoryclient or gormclient for details.
 type InternalClient interface {
-	InternalEnqueueJob(*Job) error
-	InternalSelectJob() (*Job, error)
+	InternalEnqueueJob(*Job) (bool, error)      //returns whether a new job was created. If an existing named job was updated instead, the job's ID is set to the existing ID
+	InternalEnqueueJobs([]*Job) ([]bool, error) //like InternalEnqueueJob for every job, all or nothing
+	InternalSelectJob(SelectConfig) (*Job, error)
 	InternalPendingJobs() ([]*Job, error)
-	InternalRegisterWorker(string, WorkerFunc)
+	InternalRegisterWorker(string, WorkerFunc, WorkerConfig)
 	IncRetryCount(*Job) error
 	SetStatus(*Job, int) error
 	SetFinishedAt(*Job, int64) error
 	SetNextRun(*Job, int64) error
 	SetError(*Job, string, string) error
+	SetResult(*Job, []byte) error
 	InternalCleanup(CleanUpConfig) error
 	GetNamedJob(string) (*Job, error)
+	RenewLease(*Job, string, int64) error
+	InternalReapExpiredJobs() (int, error)
+	InternalCancelJob(string) error
+	InternalCancelNamedJob(string) (string, error)
+	InternalRetryJob(string) error
+	InternalRetryFailed(JobFilter) (int, error)
+	InternalGetJob(string) (*Job, error)
+	InternalListJobs(ListQuery) ([]*Job, error)
+	InternalStats() (Stats, error)
+	InternalEnqueueBatch(*Batch, []*Job, *Job) error //queues up the batch, its jobs and its callback job, which may be nil, all or nothing
+	InternalGetBatch(string) (*Batch, error)
+}
+
+//Notifier is an optional interface for storage backends that can tell when jobs become available without being enqueued through the client, e.g. jobs enqueued by another process. The client passes in a function that wakes up its idle background workers.
+type Notifier interface {
+	InternalSetNotifier(func())
+}
+
+//JobWatcher is an optional interface for storage backends that can tell when a job has finished, so futures don't have to poll for it. InternalWatchJob returns a channel that is closed once the job with the ID has finished, and a function that stops watching it.
+type JobWatcher interface {
+	InternalWatchJob(string) (<-chan struct{}, func())
 }
 
 //Job is the internal representation of a job
 type Job struct {
-	ID             string
-	Name           string `gorm:"index"`
-	Args           []byte
-	CreatedAt      int64
-	Status         int `gorm:"index"`
-	RetryCount     int
-	MaxRetry       int
-	Error          string
-	ErrorStack     string
-	FinishedAt     int64
-	Repeat         bool
-	RepeatInterval time.Duration
-	NextRun        int64
-	NamedJob       string `gorm:"index"` //named jobs should be unique but we don't want to require a name, so I'm not using unique_index
+	ID              string
+	Name            string `gorm:"index"`
+	Args            []byte
+	CreatedAt       int64 `gorm:"index"`
+	EnqueuedAt      int64 `gorm:"index"` //unix nanoseconds, strictly increasing within a process. Orders jobs with the same priority
+	Status          int   `gorm:"index"`
+	RetryCount      int
+	MaxRetry        int
+	Error           string
+	ErrorStack      string
+	FinishedAt      int64
+	Repeat          bool
+	RepeatInterval  time.Duration
+	NextRun         int64
+	NamedJob        string `gorm:"index"` //named jobs should be unique but we don't want to require a name, so I'm not using unique_index
+	Timeout         time.Duration
+	BackoffStrategy BackoffStrategy
+	BackoffDelay    time.Duration
+	BackoffMaxDelay time.Duration
+	BackoffJitter   bool
+	Cron            string
+	Queue           string `gorm:"index"`
+	Priority        int    `gorm:"index"`
+	LockedBy        string
+	LeaseExpiresAt  int64 `gorm:"index"`
+	StartedAt       int64
+	Result          []byte
+	DependsOn       []string `gorm:"-"` //stored separately by backends that can't store lists in a job
+	BatchID         string   `gorm:"index"`
+	UniqueKey       *string  `gorm:"unique_index"` //nil if the job isn't unique. Backends may clear it once the job no longer holds it
+	UniqueUntil     int64
+}
+
+//Batch is a group of jobs enqueued together with EnqueueBatch. Once every job in it has finished, its callback job is queued up.
+type Batch struct {
+	ID            string
+	Total         int
+	Succeeded     int
+	Failed        int //jobs that failed, timed out or were cancelled
+	CreatedAt     int64
+	FinishedAt    int64
+	CallbackJobID string //waits until the batch has finished, empty if there is no callback
 }
 
 //JobConfig includes options for when a job is queued
@@ -43,20 +96,81 @@ type JobConfig struct {
 	Repeat         bool
 	RepeatInterval time.Duration
 	Identifier     string
+	Timeout        time.Duration //if set, the job is stopped and counted as failed once it has been running for this long. Overrides ClientConfig.DefaultTimeout
+	Backoff        Backoff
+	RunAt          time.Time     //if set, the job won't run before this time. For repeating jobs, this is the first run
+	RunIn          time.Duration //like RunAt, relative to the time the job is enqueued. Ignored if RunAt is set
+	Cron           string        //cron expression for repeating jobs, see the cron package for the syntax. Implies Repeat and takes precedence over RepeatInterval
+	Queue          string        //queue the job is put in, DefaultQueue if empty
+	Priority       int           //jobs with a higher priority are selected first. Jobs with the same priority run in the order they were enqueued, by their EnqueuedAt
+	Unique         *Unique       //if set, the job isn't enqueued while a job with the same key holds it
+	DependsOn      []string      //IDs of jobs that have to be done before this job runs. If one of them fails, times out or is cancelled, this job fails too. Repeating jobs are never done, so they can't be depended on. Ignored when an existing named job is updated
+}
+
+//DefaultQueue is the queue jobs are put in when their JobConfig doesn't name one
+const DefaultQueue = "default"
+
+//SelectConfig narrows down which jobs InternalSelectJob may return
+type SelectConfig struct {
+	Queues        []string       //only select jobs from these queues, or from all queues if empty
+	WorkerID      string         //stored in the selected job's LockedBy
+	LeaseDuration time.Duration  //how long the selected job is leased to the worker before it is considered lost
+	Abandoned     map[string]int //jobs per worker name that timed out while their worker is still running. Backends count them as running against MaxConcurrency
+}
+
+//BackoffStrategy selects how the delay between retries grows
+type BackoffStrategy int
+
+const (
+	//BackoffNone retries a failed job on the next poll
+	BackoffNone BackoffStrategy = iota
+	//BackoffConstant waits Delay before every retry
+	BackoffConstant
+	//BackoffLinear waits Delay times the retry count
+	BackoffLinear
+	//BackoffExponential doubles the delay after every retry, starting at Delay
+	BackoffExponential
+)
+
+//BackoffFunc returns how long to wait before retrying a job that has failed retryCount times, the last time with err
+type BackoffFunc func(retryCount int, err error) time.Duration
+
+//Backoff configures how long a failed job waits before it is retried
+type Backoff struct {
+	Strategy BackoffStrategy
+	Delay    time.Duration
+	MaxDelay time.Duration //caps the delay, zero means no cap
+	Jitter   bool          //randomizes the delay between half and all of its value
+	Func     BackoffFunc   //overrides Strategy. It can't be stored in the backend, so it only applies to retries run by the client that enqueued the job
 }
 
 //JobRef is a reference to a job (and it's client). It is passed to a WorkerFunc to get the job args
 type JobRef struct {
-	c *Client
-	j *Job
+	c         *Client
+	j         *Job
+	ctx       context.Context
+	lock      sync.Mutex
+	abandoned bool //set once the job timed out, after which the worker may no longer update it
 }
 
 //WorkerFunc is the type of function that must be implemented to be a worker
 type WorkerFunc func(j *JobRef) error
 
+//Middleware wraps a WorkerFunc, e.g. to log, time or trace every job it runs
+type Middleware func(next WorkerFunc) WorkerFunc
+
+//WorkerConfig includes options for when a worker is registered
+type WorkerConfig struct {
+	MaxConcurrency int          //how many jobs of the worker may run at the same time across all background workers, zero means no limit. Backends shared by several processes enforce it across all of them. A job that timed out counts until its worker returns, but only in the process running it
+	RateLimit      RateLimit    //how many jobs of the worker may be started over time. Backends shared by several processes share the limit between them
+	Middleware     []Middleware //wraps the worker, inside the middleware added with Client.Use
+}
+
 //ClientConfig is settings that the client uses during runtime
 type ClientConfig struct {
-	WorkerSleepTime time.Duration
+	WorkerSleepTime time.Duration //how long idle background workers wait before they look for new jobs again
+	DefaultTimeout  time.Duration //timeout for jobs that don't set one in their JobConfig. Zero means no timeout
+	LeaseDuration   time.Duration //how long a job may go without a heartbeat before it is requeued, DefaultLeaseDuration if zero
 }
 
 //CleanUpConfig includes options for CleanUp methods
@@ -65,6 +179,36 @@ type CleanUpConfig struct {
 	IncludeFailed bool
 }
 
+//JobFilter selects jobs by their fields. Empty fields match every job.
+type JobFilter struct {
+	Name           string
+	Queue          string
+	NamedJob       string
+	Statuses       []int //matches jobs with any of these statuses
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	FinishedAfter  time.Time
+	FinishedBefore time.Time
+}
+
+//ListConfig includes options for ListJobs
+type ListConfig struct {
+	Filter JobFilter
+	Cursor string //returned by the previous call to ListJobs to get the next page, empty for the first page
+	Limit  int    //maximum number of jobs returned, DefaultListLimit if zero
+}
+
+//DefaultListLimit is the number of jobs ListJobs returns when the ListConfig doesn't set a limit
+const DefaultListLimit = 100
+
+//ListQuery is what ListJobs asks the storage backend for. Jobs are listed newest first, ordered by CreatedAt and then ID, both descending.
+type ListQuery struct {
+	Filter         JobFilter
+	AfterCreatedAt int64 //if AfterID is set, only jobs that come after the job with this CreatedAt and AfterID are listed
+	AfterID        string
+	Limit          int
+}
+
 type JobInfo struct {
 	Identifier     string
 	ID             string
@@ -72,5 +216,7 @@ type JobInfo struct {
 	NextRun        time.Time
 	RepeatInterval time.Duration
 	Repeat         bool
+	Cron           string
 	Args           []byte
+	Result         []byte
 }
@@ -0,0 +1,12 @@
+package jobinator
+
+import (
+	"time"
+)
+
+//RateLimit caps how many jobs of a worker are started, using a token bucket: every job takes a token, and tokens are refilled at Limit per Per, up to Burst.
+type RateLimit struct {
+	Limit int           //jobs per Per, zero means no limit
+	Per   time.Duration //a second if zero
+	Burst int           //how many tokens can be saved up, Limit if zero
+}
@@ -0,0 +1,30 @@
+package jobinator
+
+import (
+	"errors"
+)
+
+//ErrJobNotFailed is returned when trying to retry a job that hasn't failed.
+var ErrJobNotFailed = errors.New("job hasn't failed")
+
+//RetryJob puts a job that has failed or timed out back into the queue. Its retry count and error are reset, so it gets all of its retries again. A job with DependsOn waits for the jobs it depends on again, or fails right away if one of them still hasn't finished successfully.
+func (c *Client) RetryJob(id string) error {
+	err := c.InternalRetryJob(id)
+	if err != nil {
+		return err
+	}
+	c.wakeAllWorkers()
+	return nil
+}
+
+//RetryAllFailed is like RetryJob, for every failed or timed out job matching the filter. Jobs retried together with the jobs they depend on wait for them. It returns the number of jobs that were put back into the queue.
+func (c *Client) RetryAllFailed(filter JobFilter) (int, error) {
+	n, err := c.InternalRetryFailed(filter)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		c.wakeAllWorkers()
+	}
+	return n, nil
+}
@@ -0,0 +1,55 @@
+package jobinator
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blasphemy/jobinator/cron"
+)
+
+//errNoNextRun is returned for cron jobs whose schedule never fires again.
+var errNoNextRun = errors.New("cron schedule has no next run")
+
+//nextRun returns when a repeating job should run next, following its cron schedule or RepeatInterval.
+func (j *Job) nextRun(after time.Time) (time.Time, error) {
+	if j.Cron == "" {
+		return after.Add(j.RepeatInterval), nil
+	}
+	return nextCronRun(j.Cron, after)
+}
+
+func nextCronRun(spec string, after time.Time) (time.Time, error) {
+	s, err := cron.Parse(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := s.Next(after)
+	if next.IsZero() {
+		return time.Time{}, errNoNextRun
+	}
+	return next, nil
+}
+
+//NextRuns returns up to n upcoming run times of the job, starting with NextRun. Jobs that don't repeat only have a single run.
+func (ji JobInfo) NextRuns(n int) []time.Time {
+	runs := []time.Time{}
+	if n <= 0 {
+		return runs
+	}
+	runs = append(runs, ji.NextRun)
+	if !ji.Repeat {
+		return runs
+	}
+	j := &Job{
+		Cron:           ji.Cron,
+		RepeatInterval: ji.RepeatInterval,
+	}
+	for len(runs) < n {
+		next, err := j.nextRun(runs[len(runs)-1])
+		if err != nil {
+			break
+		}
+		runs = append(runs, next)
+	}
+	return runs
+}
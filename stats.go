@@ -0,0 +1,49 @@
+package jobinator
+
+import (
+	"time"
+)
+
+//StatusCounts maps job statuses to the number of jobs with that status. See the status package for the statuses.
+type StatusCounts map[int]int
+
+//Total returns the number of jobs across all statuses.
+func (s StatusCounts) Total() int {
+	total := 0
+	for _, x := range s {
+		total += x
+	}
+	return total
+}
+
+//Stats are aggregate numbers about the jobs in a backend
+type Stats struct {
+	Statuses       StatusCounts
+	Names          map[string]StatusCounts //per job name
+	Queues         map[string]StatusCounts
+	OldestPending  time.Duration //how long the job that has been due the longest has been waiting to run
+	AverageRunTime time.Duration //average time between starting and finishing a job, over the jobs that are done
+}
+
+//init makes sure the maps are allocated, so stats without any jobs can be read the same way.
+func (s *Stats) init() {
+	if s.Statuses == nil {
+		s.Statuses = StatusCounts{}
+	}
+	if s.Names == nil {
+		s.Names = make(map[string]StatusCounts)
+	}
+	if s.Queues == nil {
+		s.Queues = make(map[string]StatusCounts)
+	}
+}
+
+//Stats returns job counts per status, job name and queue, along with timing information. It doesn't load the jobs themselves, so it is cheap enough to call from dashboards.
+func (c *Client) Stats() (Stats, error) {
+	s, err := c.InternalStats()
+	if err != nil {
+		return Stats{}, err
+	}
+	s.init()
+	return s, nil
+}
@@ -11,4 +11,15 @@ const (
 	Retry
 	//Failed is a job that has exceeded the retry limit and given up
 	Failed
+	//Timeout is a job that exceeded its execution timeout on its last allowed try
+	Timeout
+	//Cancelled is a job that was cancelled before it finished
+	Cancelled
+	//Waiting is a job that waits for the jobs it depends on to be done
+	Waiting
 )
+
+//Finished returns whether a job with the status has reached its final state and won't run again
+func Finished(s int) bool {
+	return s == Done || s == Failed || s == Timeout || s == Cancelled
+}
@@ -0,0 +1,26 @@
+package jobinator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+//ErrDuplicateJob is returned when enqueueing a unique job while another job with the same key holds it.
+var ErrDuplicateJob = errors.New("duplicate job")
+
+//Unique makes a job unique: while a job with the same key hasn't finished, or was enqueued less than Window ago, enqueueing it fails with ErrDuplicateJob.
+type Unique struct {
+	Key    string        //defaults to the job's name plus a hash of its args
+	Window time.Duration //how long after being enqueued the job keeps its key, even if it has finished. Zero means until it has finished
+}
+
+//uniqueKey returns the key of a unique job.
+func uniqueKey(name string, args []byte, u *Unique) string {
+	if u.Key != "" {
+		return u.Key
+	}
+	sum := sha256.Sum256(args)
+	return name + ":" + hex.EncodeToString(sum[:])
+}